@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// polkitAction is an action as returned by the Authority's EnumerateActions.
+type polkitAction struct {
+	ActionID         string
+	Description      string
+	Message          string
+	VendorName       string
+	VendorURL        string
+	IconName         string
+	ImplicitAny      uint32
+	ImplicitInactive uint32
+	ImplicitActive   uint32
+	Annotations      map[string]string
+}
+
+// Implicit authorizations of polkit: auth_self, auth_admin, their _keep
+// variants retaining the authorization for a while, and yes.
+const (
+	implicitSelf          = 1
+	implicitAdmin         = 2
+	implicitSelfRetained  = 3
+	implicitAdminRetained = 4
+	implicitAuthorized    = 5
+)
+
+// actionCache caches the descriptions of polkit's actions and whether they
+// retain authorizations or only ever need the user's own password.
+type actionCache struct {
+	mu           sync.Mutex
+	descriptions map[string]string
+	retained     map[string]bool
+	selfOnly     map[string]bool
+}
+
+// selfOnly reports whether action needs no administrator by default: no
+// implicit authorization is auth_admin or auth_admin_keep, and active
+// sessions get it with auth_self, auth_self_keep or without authentication.
+func (action polkitAction) selfOnly() bool {
+	for _, v := range []uint32{action.ImplicitAny, action.ImplicitInactive, action.ImplicitActive} {
+		if v == implicitAdmin || v == implicitAdminRetained {
+			return false
+		}
+	}
+
+	switch action.ImplicitActive {
+	case implicitSelf, implicitSelfRetained, implicitAuthorized:
+		return true
+	}
+
+	return false
+}
+
+// enumerateActions returns polkit's actions with texts in locale.
+func enumerateActions(conn *dbus.Conn, locale string) ([]polkitAction, error) {
+	var actions []polkitAction
+
+	obj := conn.Object("org.freedesktop.PolicyKit1", "/org/freedesktop/PolicyKit1/Authority")
+	err := obj.Call("org.freedesktop.PolicyKit1.Authority.EnumerateActions", 0, locale).Store(&actions)
+
+	return actions, err
+}
+
+// checkTrustedActions refuses trusted_actions that polkit doesn't know or
+// that need an administrator by default.
+func checkTrustedActions(ids []string) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return fmt.Errorf("failed to check trusted_actions: %w", err)
+	}
+
+	actions, err := enumerateActions(conn, "")
+	if err != nil {
+		return fmt.Errorf("failed to check trusted_actions: %w", err)
+	}
+
+	known := make(map[string]polkitAction, len(actions))
+	for _, action := range actions {
+		known[action.ActionID] = action
+	}
+
+	for _, id := range ids {
+		action, ok := known[id]
+		if !ok {
+			return fmt.Errorf("trusted_actions: unknown action %s", id)
+		}
+		if !action.selfOnly() {
+			return fmt.Errorf("trusted_actions: %s needs an administrator, it can't be trusted", id)
+		}
+	}
+
+	return nil
+}
+
+// actionDescription returns polkit's description of actionId.
+func (a *Agent) actionDescription(actionId string) string {
+	a.actions.mu.Lock()
+	defer a.actions.mu.Unlock()
+
+	a.loadActions()
+
+	return a.actions.descriptions[actionId]
+}
+
+// actionRetained reports whether actionId keeps its authorization for
+// active sessions by default, as auth_self_keep or auth_admin_keep.
+func (a *Agent) actionRetained(actionId string) bool {
+	a.actions.mu.Lock()
+	defer a.actions.mu.Unlock()
+
+	a.loadActions()
+
+	return a.actions.retained[actionId]
+}
+
+// actionSelfOnly reports whether actionId needs no administrator by
+// default, see polkitAction.selfOnly. Unknown actions never do.
+func (a *Agent) actionSelfOnly(actionId string) bool {
+	a.actions.mu.Lock()
+	defer a.actions.mu.Unlock()
+
+	a.loadActions()
+
+	return a.actions.selfOnly[actionId]
+}
+
+// loadActions fetches the action catalog once. The caller holds
+// a.actions.mu.
+func (a *Agent) loadActions() {
+	if a.actions.descriptions == nil {
+		actions, err := enumerateActions(a.bus(), conf().Locale)
+		if err != nil {
+			warnf("Failed to enumerate polkit actions: %v", err)
+			return
+		}
+
+		a.actions.descriptions = make(map[string]string, len(actions))
+		a.actions.retained = make(map[string]bool)
+		a.actions.selfOnly = make(map[string]bool)
+		for _, action := range actions {
+			a.actions.descriptions[action.ActionID] = action.Description
+
+			if action.ImplicitActive == implicitSelfRetained || action.ImplicitActive == implicitAdminRetained {
+				a.actions.retained[action.ActionID] = true
+			}
+			if action.selfOnly() {
+				a.actions.selfOnly[action.ActionID] = true
+			}
+		}
+	}
+}
+
+// resolveMessage returns the message shown by the prompt: polkit's message,
+// else the action's description, else default_message.
+func (a *Agent) resolveMessage(actionId, message string) string {
+	if message != "" {
+		return message
+	}
+
+	if description := a.actionDescription(actionId); description != "" {
+		return description
+	}
+
+	return conf().DefaultMessage
+}
+
+// actionName returns a friendly name for actionId: the one configured in
+// action_names, else polkit's description, else the id itself.
+func (a *Agent) actionName(actionId string) string {
+	if name, ok := conf().ActionNames[actionId]; ok {
+		return name
+	}
+
+	if description := a.actionDescription(actionId); description != "" {
+		return description
+	}
+
+	return actionId
+}
+
+// actionOverride returns the entry of actions for actionId. An exact id wins
+// over patterns, among matching patterns the longest, most specific one.
+func actionOverride(actionId string) (ActionOverride, bool) {
+	actions := conf().Actions
+
+	if o, ok := actions[actionId]; ok {
+		return o, true
+	}
+
+	best := ""
+	for pattern := range actions {
+		if ok, _ := filepath.Match(pattern, actionId); ok && len(pattern) > len(best) {
+			best = pattern
+		}
+	}
+
+	if best == "" {
+		return ActionOverride{}, false
+	}
+
+	return actions[best], true
+}
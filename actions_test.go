@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestPolkitActionSelfOnly(t *testing.T) {
+	tests := []struct {
+		name                  string
+		any, inactive, active uint32
+		want                  bool
+	}{
+		{name: "auth_self", any: implicitSelf, inactive: implicitSelf, active: implicitSelf, want: true},
+		{name: "auth_self_keep", any: 0, inactive: 0, active: implicitSelfRetained, want: true},
+		{name: "yes", any: 0, inactive: 0, active: implicitAuthorized, want: true},
+		{name: "auth_admin", any: implicitAdmin, inactive: implicitAdmin, active: implicitAdmin},
+		{name: "auth_admin_keep", any: 0, inactive: 0, active: implicitAdminRetained},
+		{name: "admin when inactive", any: implicitAdmin, inactive: implicitAdmin, active: implicitSelf},
+		{name: "no", any: 0, inactive: 0, active: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			action := polkitAction{ImplicitAny: tt.any, ImplicitInactive: tt.inactive, ImplicitActive: tt.active}
+			if got := action.selfOnly(); got != tt.want {
+				t.Errorf("selfOnly() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// auditRecord is a line of the audit log. UID is nil when the request
+// failed before the user was known.
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	ActionID string    `json:"action_id"`
+	UID      *uint32   `json:"uid,omitempty"`
+	User     string    `json:"user"`
+	Result   string    `json:"result"`
+	Attempts int       `json:"attempts"`
+}
+
+// auditLog appends records to the file at audit_log. The file is reopened
+// when it was rotated or the path changed on reload.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+var audit auditLog
+
+// write appends rec as one JSON line. Failures are logged, they never
+// affect the authentication.
+func (l *auditLog) write(rec auditRecord) {
+	path := conf().AuditLog
+	if path == "" {
+		return
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		warnf("Failed to encode audit record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.open(path); err != nil {
+		warnf("Failed to open audit log %s: %v", path, err)
+		return
+	}
+
+	// other processes appending to the same file must not interleave
+	// with the line
+	fd := int(l.file.Fd())
+	if err := syscall.Flock(fd, syscall.LOCK_EX); err != nil {
+		warnf("Failed to lock audit log %s: %v", path, err)
+		return
+	}
+	defer syscall.Flock(fd, syscall.LOCK_UN)
+
+	if _, err := l.file.Write(line); err != nil {
+		warnf("Failed to write audit log %s: %v", path, err)
+	}
+}
+
+// open makes l.file the file at path, reopening it when path names another
+// file than the open one, f.e. after logrotate moved it away. The caller
+// holds l.mu.
+func (l *auditLog) open(path string) error {
+	if l.file != nil && l.path == path {
+		current, err := l.file.Stat()
+		if err == nil {
+			if onDisk, err := os.Stat(path); err == nil && os.SameFile(current, onDisk) {
+				return nil
+			}
+		}
+
+		infof("Audit log %s was rotated, reopening", path)
+	}
+
+	// a symlink planted at path must not make root append elsewhere
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|syscall.O_NOFOLLOW, 0o600)
+	if err != nil {
+		return err
+	}
+
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+
+	l.file, l.path = f, path
+
+	return nil
+}
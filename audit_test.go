@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLogUID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	old := conf()
+	t.Cleanup(func() { config.Store(old) })
+	updateConfig(func(c *Config) { c.AuditLog = path })
+
+	var l auditLog
+	t.Cleanup(func() { l.file.Close() })
+
+	root := uint32(0)
+	l.write(auditRecord{Time: time.Now(), ActionID: "a", UID: &root, User: "root", Result: "success"})
+	l.write(auditRecord{Time: time.Now(), ActionID: "b", Result: "failure"})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("audit log has %d lines, want 2:\n%s", len(lines), data)
+	}
+
+	for i, want := range []bool{true, false} {
+		var rec map[string]any
+		if err := json.Unmarshal(lines[i], &rec); err != nil {
+			t.Fatalf("line %d isn't JSON: %v", i+1, err)
+		}
+		if _, ok := rec["uid"]; ok != want {
+			t.Errorf("line %d has uid: %v, want %v: %s", i+1, ok, want, lines[i])
+		}
+	}
+}
+
+func TestAuditLogRefusesSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	path := filepath.Join(dir, "audit.log")
+
+	if err := os.WriteFile(target, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, path); err != nil {
+		t.Fatal(err)
+	}
+
+	old := conf()
+	t.Cleanup(func() { config.Store(old) })
+	updateConfig(func(c *Config) { c.AuditLog = path })
+
+	var l auditLog
+	l.write(auditRecord{Time: time.Now(), ActionID: "a", Result: "success"})
+
+	if l.file != nil {
+		l.file.Close()
+		t.Errorf("audit log opened through a symlink")
+	}
+
+	data, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Errorf("symlink target was written: %s", data)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// batchRequests collects the requests arriving while another request for
+// the same identity in the same session waits to prompt, so one prompt
+// covers all of them. See batch_window_ms.
+type batchRequests struct {
+	mu      sync.Mutex
+	entries map[string]*batchEntry
+}
+
+// batchEntry is a prompt shared by the requests that joined it.
+type batchEntry struct {
+	dedupEntry
+
+	// actions are the names of the joined requests' actions, guarded by
+	// batchRequests.mu
+	actions []string
+}
+
+// batchKey scopes a batch: one authentication only ever answers requests
+// for the same uid, of the same kind, in the same session.
+func batchKey(uid uint32, kind, session string) string {
+	return fmt.Sprintf("%d\x00%s\x00%s", uid, kind, session)
+}
+
+// join adds a request for action to the open batch for key. If there is
+// none a new batch is opened and leader is true; the caller then has to
+// close it, authenticate and finish it.
+func (b *batchRequests) join(key, action string) (entry *batchEntry, leader bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.entries == nil {
+		b.entries = make(map[string]*batchEntry)
+	}
+
+	if e, ok := b.entries[key]; ok && !e.finished() {
+		e.actions = append(e.actions, action)
+		return e, false
+	}
+
+	entry = &batchEntry{
+		dedupEntry: dedupEntry{started: time.Now(), done: make(chan struct{})},
+		actions:    []string{action},
+	}
+	b.entries[key] = entry
+
+	return entry, true
+}
+
+// close stops entry from taking more requests and returns the actions it
+// covers. Later requests open a new batch.
+func (b *batchRequests) close(key string, entry *batchEntry) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.entries[key] == entry {
+		delete(b.entries, key)
+	}
+
+	return slices.Clone(entry.actions)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBatchRequests(t *testing.T) {
+	var b batchRequests
+
+	key := batchKey(1000, "self", "c2")
+
+	leader, ok := b.join(key, "Mount a disk")
+	if !ok {
+		t.Fatalf("first request isn't the leader")
+	}
+
+	follower, ok := b.join(key, "Install a package")
+	if ok || follower != leader {
+		t.Fatalf("second request didn't join the batch")
+	}
+
+	if _, ok := b.join(batchKey(1001, "self", "c2"), "Mount a disk"); !ok {
+		t.Errorf("request of another user joined the batch")
+	}
+	if _, ok := b.join(batchKey(1000, "admin", "c2"), "Mount a disk"); !ok {
+		t.Errorf("request of another kind joined the batch")
+	}
+	if _, ok := b.join(batchKey(1000, "self", "c3"), "Mount a disk"); !ok {
+		t.Errorf("request of another session joined the batch")
+	}
+
+	actions := b.close(key, leader)
+	if want := []string{"Mount a disk", "Install a package"}; !reflect.DeepEqual(actions, want) {
+		t.Errorf("close() = %q, want %q", actions, want)
+	}
+
+	if e, ok := b.join(key, "Reboot"); !ok || e == leader {
+		t.Errorf("request joined a closed batch")
+	}
+}
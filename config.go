@@ -0,0 +1,726 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config holds the settings read from config.toml.
+type Config struct {
+	// DisplayWaitSeconds is how long to wait for the user's Wayland display
+	// to show up before giving up on a request.
+	DisplayWaitSeconds int `toml:"display_wait_seconds"`
+
+	// NestedDisplay selects the display used when nested compositors are
+	// detected: "outer", "inner" or a display name like "wayland-1".
+	NestedDisplay string `toml:"nested_display"`
+
+	// EnvCommand prints the prompt's session environment instead of it
+	// being read from the user's processes.
+	EnvCommand Command `toml:"env_command"`
+
+	// EnvCacheSeconds is how long the detected session environment is
+	// reused before scanning the user's processes again.
+	EnvCacheSeconds int `toml:"env_cache_seconds"`
+
+	// UserLookupRetries is how often a failed user lookup is retried.
+	UserLookupRetries int `toml:"user_lookup_retries"`
+
+	// MaxFailures consecutive failed attempts of a uid lock it out for
+	// LockoutDuration seconds. Either being 0 disables the lockout.
+	MaxFailures     int `toml:"max_failures"`
+	LockoutDuration int `toml:"lockout_duration"`
+
+	// CacheDuration is how many seconds a successful authentication of a
+	// uid approves further requests of that uid without a prompt, 0
+	// disables it.
+	CacheDuration int `toml:"cache_duration"`
+
+	// SubjectKind is the subject the agent registers for: "unix-session"
+	// or "unix-process".
+	SubjectKind string `toml:"subject_kind"`
+
+	// SessionBackend detects the session to register for: "auto",
+	// "logind", "elogind" or "env".
+	SessionBackend string `toml:"session_backend"`
+
+	// ShowPAMMessages shows PAM's error and info messages, f.e. about a
+	// locked account, using the prompt.
+	ShowPAMMessages bool `toml:"show_pam_messages"`
+
+	// PAMConversation sets how PAM prompts are answered.
+	PAMConversation PAMConversation `toml:"pam_conversation"`
+
+	// PAMService is the PAM service passwords are checked with.
+	PAMService string `toml:"pam_service"`
+
+	// PAMServiceRemote is the PAM service used for remote sessions. Empty
+	// uses PAMService.
+	PAMServiceRemote string `toml:"pam_service_remote"`
+
+	// PolkitHelper is the path of polkit-agent-helper-1, which checks the
+	// password when wpka doesn't run as root. Empty looks in the usual
+	// places.
+	PolkitHelper string `toml:"polkit_helper"`
+
+	// MetricsListen is the loopback address serving Prometheus metrics.
+	// Empty disables the endpoint.
+	MetricsListen string `toml:"metrics_listen"`
+
+	// TrustedActions are action ids that are approved without a prompt.
+	// Only exact ids of actions that need no administrator are accepted.
+	TrustedActions []string `toml:"trusted_actions"`
+
+	// Locale is passed to polkit on registration and to the prompt as
+	// LC_MESSAGES. Empty takes it from the session environment.
+	Locale string `toml:"locale"`
+
+	// InputMode is how the password is read: "stdout" takes stdout without
+	// its trailing newline, "raw" all of stdout and "fd" everything written
+	// to fd 3.
+	InputMode string `toml:"input_mode"`
+
+	// DedupWindowMs is the window in which a request identical to one still
+	// being authenticated shares its result, see dedupKey.
+	DedupWindowMs int `toml:"dedup_window_ms"`
+
+	// BatchWindowMs is how long a request of a user waits before prompting
+	// for other requests of the same user and session to join its prompt,
+	// 0 disables it.
+	BatchWindowMs int `toml:"batch_window_ms"`
+
+	// Mask is passed to the prompt as WPKA_MASK, hinting how typed
+	// characters should be shown.
+	Mask string `toml:"mask"`
+
+	// DefaultMessage is shown when neither polkit's message nor the
+	// action's description is available.
+	DefaultMessage string `toml:"default_message"`
+
+	// ActionNames maps action ids to friendly names for the prompt.
+	ActionNames map[string]string `toml:"action_names"`
+
+	// AllowEmptyActionID lets requests without an action id through. polkit
+	// always sends one, so these are denied by default.
+	AllowEmptyActionID bool `toml:"allow_empty_action_id"`
+
+	// ConfirmActions maps action ids to a phrase the user has to type
+	// before authenticating. An empty phrase requires the action id.
+	ConfirmActions map[string]string `toml:"confirm_actions"`
+
+	// Actions customizes the prompt of action ids. Keys are exact ids or
+	// patterns like "org.freedesktop.packagekit.*".
+	Actions map[string]ActionOverride `toml:"actions"`
+
+	// LogFormat is one of "text", "json", "logfmt" or "journal".
+	LogFormat string `toml:"log_format"`
+
+	// ToolkitHints are the toolkits told to use wayland in the prompt's
+	// environment: gtk, qt, clutter, sdl, efl or all.
+	ToolkitHints []string `toml:"toolkit_hints"`
+
+	// ShutdownDrainSeconds is how long requests in flight may take to finish
+	// when shutting down.
+	ShutdownDrainSeconds int `toml:"shutdown_drain_seconds"`
+
+	// ManagementInterface exposes settings over D-Bus, changing them
+	// requires root.
+	ManagementInterface bool `toml:"management_interface"`
+
+	// CleanStaleState removes runtime state left behind by an instance
+	// that crashed.
+	CleanStaleState bool `toml:"clean_stale_state"`
+
+	// LockMemory locks wpka's memory so passwords are never swapped out.
+	LockMemory bool `toml:"lock_memory"`
+
+	// StrictConfigSecurity refuses to start when the user's config file or
+	// a directory leading to it can be modified by others than the user and
+	// root.
+	StrictConfigSecurity bool `toml:"strict_config_security"`
+
+	// DetectPromptErrors treats error messages printed by a failing prompt
+	// as a broken prompt command instead of a cancelled prompt.
+	DetectPromptErrors bool `toml:"detect_prompt_errors"`
+
+	// AuthTimeoutSeconds is how long a request may take before its prompt
+	// is closed, 0 disables it.
+	AuthTimeoutSeconds int `toml:"auth_timeout_seconds"`
+
+	// MaxRetries is how often the password is asked again after a failed
+	// attempt.
+	MaxRetries int `toml:"max_retries"`
+
+	// MinUID is the lowest uid wpka authenticates.
+	MinUID uint32 `toml:"min_uid"`
+
+	// AllowRootSelf allows authenticating root for actions that only need
+	// the user's own password.
+	AllowRootSelf bool `toml:"allow_root_self"`
+
+	// PromptCommand collects the password. When empty the arguments wpka
+	// was started with are run through sh -c.
+	PromptCommand Command `toml:"prompt_command"`
+
+	// PromptCommands is tried in order instead of PromptCommand, the first
+	// one whose executable is found is used.
+	PromptCommands []Command `toml:"prompt_commands"`
+
+	// BeforePromptCommand and AfterPromptCommand are run before and after
+	// each prompt, f.e. to grab focus or disable shortcuts meanwhile.
+	BeforePromptCommand Command `toml:"before_prompt_command"`
+	AfterPromptCommand  Command `toml:"after_prompt_command"`
+
+	// AuditLog is a file every authentication request is appended to as a
+	// JSON line, empty disables it.
+	AuditLog string `toml:"audit_log"`
+
+	// OnAuthCommand is run after every authentication request with its
+	// result, without waiting for it.
+	OnAuthCommand Command `toml:"on_auth_command"`
+
+	// OnRegisterCommand is run once after the agent has been registered.
+	OnRegisterCommand Command `toml:"on_register_command"`
+
+	// OnUnregisterCommand is run once after the agent has been
+	// unregistered on a clean shutdown.
+	OnUnregisterCommand Command `toml:"on_unregister_command"`
+
+	// NotifyOnFailure sends a desktop notification when the last attempt
+	// of a request failed.
+	NotifyOnFailure bool `toml:"notify_on_failure"`
+
+	// OnFailureCommand is run after every failed authentication.
+	OnFailureCommand Command `toml:"on_failure_command"`
+
+	// OnFailureRunAs is the user OnFailureCommand runs as: "user" or
+	// "root". The user's config can't set it, see userConfig.
+	OnFailureRunAs string `toml:"on_failure_run_as"`
+}
+
+// PAMConversation maps PAM prompt styles to their answer: "password",
+// "username" or "empty". The prompts after the password additionally accept
+// "prompt", asking the user again.
+type PAMConversation struct {
+	EchoOff              string `toml:"echo_off"`
+	EchoOn               string `toml:"echo_on"`
+	EchoOffAfterPassword string `toml:"echo_off_after_password"`
+	EchoOnAfterPassword  string `toml:"echo_on_after_password"`
+}
+
+// ActionOverride replaces parts of the prompt for matching actions. Empty
+// fields keep the default.
+type ActionOverride struct {
+	Message       string  `toml:"message"`
+	Icon          string  `toml:"icon"`
+	PromptCommand Command `toml:"prompt_command"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		DisplayWaitSeconds: 0,
+		NestedDisplay:      "outer",
+		SessionBackend:     "auto",
+		SubjectKind:        "unix-session",
+		UserLookupRetries:  2,
+		OnFailureRunAs:     "user",
+		PAMService:         "polkit-1",
+		AllowRootSelf:      true,
+		MaxRetries:         3,
+		MaxFailures:        5,
+		LockoutDuration:    60,
+		AuthTimeoutSeconds: 120,
+		DetectPromptErrors: true,
+		CleanStaleState:    true,
+		PAMConversation: PAMConversation{
+			EchoOff: "password",
+			EchoOn:  "username",
+
+			EchoOffAfterPassword: "prompt",
+			EchoOnAfterPassword:  "prompt",
+		},
+		DefaultMessage: "Authentication is required",
+		LogFormat:      "text",
+		InputMode:      "stdout",
+		ToolkitHints:   []string{"gtk"},
+	}
+}
+
+// config holds the active Config. A reload replaces it as a whole, so
+// it's never modified in place.
+var config atomic.Pointer[Config]
+
+func init() {
+	c := defaultConfig()
+	config.Store(&c)
+}
+
+// conf returns the active config.
+func conf() *Config {
+	return config.Load()
+}
+
+// updateConfig replaces the active config with a copy changed by fn.
+func updateConfig(fn func(c *Config)) {
+	c := *conf()
+	fn(&c)
+	config.Store(&c)
+}
+
+// systemConfigPath is the config holding all settings. wpka runs as root
+// and they decide how passwords are checked and what runs as root, so only
+// a root-owned file may set them.
+const systemConfigPath = "/etc/wpka/config.toml"
+
+// userConfigPath returns the location of the invoking user's config.toml.
+// When running under sudo the invoking user's config directory is used.
+func userConfigPath() (string, error) {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "wpka", "config.toml"), nil
+	}
+
+	home := ""
+
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		u, err := user.Lookup(sudoUser)
+		if err != nil {
+			return "", err
+		}
+		home = u.HomeDir
+	} else {
+		var err error
+		home, err = os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return filepath.Join(home, ".config", "wpka", "config.toml"), nil
+}
+
+// userConfig holds the keys the invoking user's config.toml may set. They
+// only change what the prompt shows.
+type userConfig struct {
+	Locale         *string                       `toml:"locale"`
+	Mask           *string                       `toml:"mask"`
+	DefaultMessage *string                       `toml:"default_message"`
+	ActionNames    map[string]string             `toml:"action_names"`
+	Actions        map[string]userActionOverride `toml:"actions"`
+}
+
+// userActionOverride is the part of an ActionOverride the user may set.
+type userActionOverride struct {
+	Message string `toml:"message"`
+	Icon    string `toml:"icon"`
+}
+
+// applyUserConfig reads the user's config at path on top of c. Keys other
+// than those of userConfig are refused.
+func applyUserConfig(c *Config, path string) error {
+	var u userConfig
+
+	md, err := toml.DecodeFile(path, &u)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read config %s: %v", path, err)
+	}
+
+	if keys := md.Undecoded(); len(keys) > 0 {
+		return fmt.Errorf("config %s: %s can only be set in %s", path, keys[0], systemConfigPath)
+	}
+
+	if err := checkConfigPermissions(path, invokingUID(), c.StrictConfigSecurity); err != nil {
+		return err
+	}
+
+	if u.Locale != nil {
+		c.Locale = *u.Locale
+	}
+	if u.Mask != nil {
+		c.Mask = *u.Mask
+	}
+	if u.DefaultMessage != nil {
+		c.DefaultMessage = *u.DefaultMessage
+	}
+
+	if len(u.ActionNames) > 0 {
+		names := make(map[string]string, len(c.ActionNames)+len(u.ActionNames))
+		maps.Copy(names, c.ActionNames)
+		maps.Copy(names, u.ActionNames)
+		c.ActionNames = names
+	}
+
+	if len(u.Actions) > 0 {
+		actions := make(map[string]ActionOverride, len(c.Actions)+len(u.Actions))
+		maps.Copy(actions, c.Actions)
+		for pattern, o := range u.Actions {
+			a := actions[pattern]
+			if o.Message != "" {
+				a.Message = o.Message
+			}
+			if o.Icon != "" {
+				a.Icon = o.Icon
+			}
+			actions[pattern] = a
+		}
+		c.Actions = actions
+	}
+
+	return nil
+}
+
+// checkConfigPermissions checks that the config file at path and the
+// directories leading to it belong to root or owner and can't be written by
+// anyone else, who could otherwise swap in their own settings. A violation
+// is logged with the owner and mode found, strict turns it into an error.
+func checkConfigPermissions(path string, owner uint32, strict bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	infof("Config %s: owner %s, mode %s", path, fileOwner(info), info.Mode().Perm())
+
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+
+	for p := resolved; ; p = filepath.Dir(p) {
+		if err := checkConfigOwner(p, owner); err != nil {
+			if strict {
+				return fmt.Errorf("config %s: %w", path, err)
+			}
+			warnf("Config %s: %v", path, err)
+			return nil
+		}
+
+		if p == "/" {
+			return nil
+		}
+	}
+}
+
+// checkConfigOwner checks a single file or directory for
+// checkConfigPermissions. Directories writable by anyone but with the
+// sticky bit, like /tmp, are fine when root owns them.
+func checkConfigOwner(path string, owner uint32) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("failed to get the owner of %s", path)
+	}
+
+	mode := info.Mode()
+	sticky := mode.IsDir() && mode&os.ModeSticky != 0 && st.Uid == 0
+
+	if st.Uid != 0 && st.Uid != owner {
+		want := "root"
+		if owner != 0 {
+			want = fmt.Sprintf("root or uid %d", owner)
+		}
+		return fmt.Errorf("%s is owned by %s, not %s (mode %s)", path, fileOwner(info), want, mode.Perm())
+	}
+
+	if mode.Perm()&0o022 != 0 && !sticky {
+		return fmt.Errorf("%s is writable by group or others (owner %s, mode %s)", path, fileOwner(info), mode.Perm())
+	}
+
+	return nil
+}
+
+// fileOwner returns the uid:gid of info for logging.
+func fileOwner(info fs.FileInfo) string {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%d:%d", st.Uid, st.Gid)
+	}
+
+	return "unknown"
+}
+
+// invokingUID returns the uid of the user invoking sudo, else wpka's own.
+func invokingUID() uint32 {
+	if uid, err := strconv.ParseUint(os.Getenv("SUDO_UID"), 10, 32); err == nil {
+		return uint32(uid)
+	}
+
+	return uint32(os.Getuid())
+}
+
+// loadConfig reads systemConfigPath and then the user's config.toml on top
+// of the defaults. Missing files are not an error.
+func loadConfig() (Config, error) {
+	path, err := userConfigPath()
+	if err != nil {
+		return defaultConfig(), fmt.Errorf("failed to determine config path: %v", err)
+	}
+
+	return loadConfigFiles(systemConfigPath, path)
+}
+
+// loadConfigFiles reads the system config at systemPath and the user config
+// at userPath on top of the defaults and validates the result.
+func loadConfigFiles(systemPath, userPath string) (Config, error) {
+	c := defaultConfig()
+
+	// checked before reading, a file others can write is never used
+	if err := checkConfigPermissions(systemPath, 0, true); err == nil {
+		if _, err := toml.DecodeFile(systemPath, &c); err != nil {
+			return c, fmt.Errorf("failed to read config %s: %v", systemPath, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return c, err
+	}
+
+	if err := applyUserConfig(&c, userPath); err != nil {
+		return c, err
+	}
+
+	if c.DisplayWaitSeconds < 0 {
+		return c, fmt.Errorf("display_wait_seconds must not be negative")
+	}
+
+	if c.EnvCacheSeconds < 0 {
+		return c, fmt.Errorf("env_cache_seconds must not be negative")
+	}
+
+	if c.DedupWindowMs < 0 {
+		return c, fmt.Errorf("dedup_window_ms must not be negative")
+	}
+
+	if c.BatchWindowMs < 0 {
+		return c, fmt.Errorf("batch_window_ms must not be negative")
+	}
+
+	if c.ShutdownDrainSeconds < 0 {
+		return c, fmt.Errorf("shutdown_drain_seconds must not be negative")
+	}
+
+	if c.PAMService == "" {
+		return c, fmt.Errorf("pam_service must not be empty")
+	}
+
+	if c.PolkitHelper != "" && !filepath.IsAbs(c.PolkitHelper) {
+		return c, fmt.Errorf("polkit_helper must be an absolute path")
+	}
+
+	if c.AuthTimeoutSeconds < 0 {
+		return c, fmt.Errorf("auth_timeout_seconds must not be negative")
+	}
+
+	if c.MaxFailures < 0 {
+		return c, fmt.Errorf("max_failures must not be negative")
+	}
+
+	if c.LockoutDuration < 0 {
+		return c, fmt.Errorf("lockout_duration must not be negative")
+	}
+
+	if !c.PromptCommand.Empty() && len(c.PromptCommands) > 0 {
+		return c, fmt.Errorf("set either prompt_command or prompt_commands")
+	}
+
+	for pattern := range c.Actions {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return c, fmt.Errorf("invalid pattern in actions: %q", pattern)
+		}
+	}
+
+	if c.AuditLog != "" && !filepath.IsAbs(c.AuditLog) {
+		return c, fmt.Errorf("audit_log must be an absolute path")
+	}
+
+	if c.CacheDuration < 0 {
+		return c, fmt.Errorf("cache_duration must not be negative")
+	}
+
+	if c.MaxRetries < 0 {
+		return c, fmt.Errorf("max_retries must not be negative")
+	}
+
+	if c.UserLookupRetries < 0 {
+		return c, fmt.Errorf("user_lookup_retries must not be negative")
+	}
+
+	switch c.SubjectKind {
+	case "unix-session", "unix-process":
+	default:
+		return c, fmt.Errorf("unknown subject_kind %q", c.SubjectKind)
+	}
+
+	switch c.SessionBackend {
+	case "auto", "logind", "elogind", "env":
+	default:
+		return c, fmt.Errorf("unknown session_backend %q", c.SessionBackend)
+	}
+
+	for _, v := range []string{c.PAMConversation.EchoOff, c.PAMConversation.EchoOn} {
+		switch v {
+		case "password", "username", "empty":
+		default:
+			return c, fmt.Errorf("unknown pam_conversation answer %q", v)
+		}
+	}
+
+	for _, v := range []string{c.PAMConversation.EchoOffAfterPassword, c.PAMConversation.EchoOnAfterPassword} {
+		switch v {
+		case "prompt", "password", "username", "empty":
+		default:
+			return c, fmt.Errorf("unknown pam_conversation answer %q", v)
+		}
+	}
+
+	switch c.OnFailureRunAs {
+	case "user", "root":
+	default:
+		return c, fmt.Errorf("unknown on_failure_run_as %q", c.OnFailureRunAs)
+	}
+
+	switch c.InputMode {
+	case "stdout", "raw", "fd":
+	default:
+		return c, fmt.Errorf("unknown input_mode %q", c.InputMode)
+	}
+
+	switch c.LogFormat {
+	case "text", "json", "logfmt", "journal":
+	default:
+		return c, fmt.Errorf("unknown log_format %q", c.LogFormat)
+	}
+
+	for _, v := range c.ToolkitHints {
+		if _, ok := toolkitBackends[v]; !ok && v != "all" {
+			return c, fmt.Errorf("unknown toolkit in toolkit_hints: %s", v)
+		}
+	}
+
+	for _, v := range c.TrustedActions {
+		if v == "" || strings.ContainsAny(v, "*?[") {
+			return c, fmt.Errorf("trusted_actions only accepts exact action ids, got %q", v)
+		}
+	}
+
+	if len(c.TrustedActions) > 0 {
+		if err := checkTrustedActions(c.TrustedActions); err != nil {
+			return c, err
+		}
+	}
+
+	return c, nil
+}
+
+// pamServiceFlag is the value of --pam-service, it overrides pam_service
+// across reloads.
+var pamServiceFlag string
+
+// flagPAMServices are the PAM services --pam-service accepts besides
+// pam_service and pam_service_remote. Any other service has to be named in
+// /etc/wpka/config.toml, a stack like one with pam_permit would let the
+// password check be skipped.
+var flagPAMServices = []string{"polkit-1", "login"}
+
+// applyPAMServiceFlag sets c.PAMService to pamServiceFlag when it's allowed.
+func applyPAMServiceFlag(c *Config) error {
+	if pamServiceFlag == "" {
+		return nil
+	}
+
+	allowed := append([]string{c.PAMService, c.PAMServiceRemote}, flagPAMServices...)
+	if !slices.Contains(allowed, pamServiceFlag) {
+		return fmt.Errorf("--pam-service only accepts %s or a service set in %s, got %q", strings.Join(flagPAMServices, ", "), systemConfigPath, pamServiceFlag)
+	}
+
+	c.PAMService = pamServiceFlag
+
+	return nil
+}
+
+// restartKeys are settings only read at startup. A reload keeps their old
+// value.
+var restartKeys = map[string]bool{
+	"session_backend":      true,
+	"subject_kind":         true,
+	"locale":               true,
+	"log_format":           true,
+	"metrics_listen":       true,
+	"management_interface": true,
+	"lock_memory":          true,
+	"clean_stale_state":    true,
+	"on_register_command":  true,
+}
+
+// reloadConfig reads config.toml again and swaps it in for the following
+// requests. An invalid config keeps the old one.
+func reloadConfig() {
+	c, err := loadConfig()
+	if err == nil {
+		err = applyPAMServiceFlag(&c)
+	}
+	if err == nil {
+		err = selectPromptCommand(&c)
+	}
+	if err == nil && os.Geteuid() != 0 {
+		applyUnprivileged(&c)
+	}
+	if err != nil {
+		warnf("Failed to reload config, keeping the current one: %v", err)
+		return
+	}
+
+	old := conf()
+
+	// values resolved at startup: the session's locale, and text when the
+	// journal was unavailable
+	if c.Locale == "" {
+		c.Locale = old.Locale
+	}
+	if c.LogFormat == "journal" && old.LogFormat == "text" {
+		c.LogFormat = old.LogFormat
+	}
+
+	var changed []string
+
+	oldValue, newValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(&c).Elem()
+	for i := 0; i < newValue.NumField(); i++ {
+		key := newValue.Type().Field(i).Tag.Get("toml")
+		if reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+
+		if restartKeys[key] {
+			warnf("Changing %s requires a restart, keeping the current value", key)
+			newValue.Field(i).Set(oldValue.Field(i))
+			continue
+		}
+
+		changed = append(changed, key)
+	}
+
+	config.Store(&c)
+
+	if len(changed) == 0 {
+		infof("Reloaded config, nothing changed")
+		return
+	}
+
+	infof("Reloaded config, changed: %s", strings.Join(changed, ", "))
+}
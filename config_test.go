@@ -0,0 +1,169 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestUserConfig(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.toml")
+
+	path := writeConfig(t, `
+mask = "•"
+default_message = "Password please"
+
+[action_names]
+"org.example.a" = "Example"
+
+[actions."org.example.*"]
+icon = "dialog-password"
+`)
+
+	c, err := loadConfigFiles(missing, path)
+	if err != nil {
+		t.Fatalf("loadConfigFiles() failed: %v", err)
+	}
+
+	if c.Mask != "•" || c.DefaultMessage != "Password please" || c.ActionNames["org.example.a"] != "Example" {
+		t.Errorf("user config not applied: %+v", c)
+	}
+	if c.Actions["org.example.*"].Icon != "dialog-password" {
+		t.Errorf("actions icon not applied: %+v", c.Actions)
+	}
+}
+
+func TestUserConfigRefusesPrivilegedKeys(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.toml")
+
+	for _, content := range []string{
+		`trusted_actions = ["org.example.a"]`,
+		`pam_service = "other"`,
+		`on_failure_run_as = "root"`,
+		`audit_log = "/etc/shadow"`,
+		`cache_duration = 3600`,
+		`min_uid = 0`,
+		`allow_root_self = true`,
+		`env_command = "id"`,
+		`prompt_command = "fuzzel --dmenu"`,
+		`strict_config_security = false`,
+		"[actions.\"org.example.a\"]\nprompt_command = \"id\"",
+	} {
+		t.Run(content, func(t *testing.T) {
+			_, err := loadConfigFiles(missing, writeConfig(t, content))
+			if err == nil || !strings.Contains(err.Error(), systemConfigPath) {
+				t.Errorf("loadConfigFiles() = %v, want the key refused", err)
+			}
+		})
+	}
+}
+
+func TestCheckConfigPermissions(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to own the test files")
+	}
+
+	path := writeConfig(t, "")
+	if err := checkConfigPermissions(path, 0, true); err != nil {
+		t.Fatalf("root-owned 0600 config refused: %v", err)
+	}
+
+	if err := os.Chmod(path, 0o664); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkConfigPermissions(path, 0, true); err == nil {
+		t.Errorf("group-writable config accepted")
+	}
+	if err := checkConfigPermissions(path, 0, false); err != nil {
+		t.Errorf("group-writable config refused without strict: %v", err)
+	}
+
+	if err := os.Chmod(path, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chown(path, 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkConfigPermissions(path, 0, true); err == nil {
+		t.Errorf("config owned by another user accepted")
+	}
+	if err := checkConfigPermissions(path, 1000, true); err != nil {
+		t.Errorf("config owned by the invoking user refused: %v", err)
+	}
+
+	if err := os.Chown(path, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(filepath.Dir(path), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkConfigPermissions(path, 0, true); err == nil {
+		t.Errorf("config in a world-writable directory accepted")
+	}
+}
+
+func TestOnFailureRunAsRootOnlyFromSystemConfig(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to own the system config")
+	}
+
+	system := writeConfig(t, `on_failure_run_as = "root"`)
+
+	c, err := loadConfigFiles(system, filepath.Join(t.TempDir(), "missing.toml"))
+	if err != nil {
+		t.Fatalf("loadConfigFiles() failed: %v", err)
+	}
+	if c.OnFailureRunAs != "root" {
+		t.Errorf("on_failure_run_as = %q from the system config, want root", c.OnFailureRunAs)
+	}
+
+	if _, err := loadConfigFiles(system, writeConfig(t, `on_failure_run_as = "user"`)); err == nil {
+		t.Errorf("user config setting on_failure_run_as accepted")
+	}
+}
+
+func TestApplyPAMServiceFlag(t *testing.T) {
+	t.Cleanup(func() { pamServiceFlag = "" })
+
+	for _, tt := range []struct {
+		flag    string
+		want    string
+		wantErr bool
+	}{
+		{flag: "", want: "polkit-1-custom"},
+		{flag: "login", want: "login"},
+		{flag: "polkit-1", want: "polkit-1"},
+		{flag: "sshd-custom", want: "sshd-custom"},
+		{flag: "permit", wantErr: true},
+		{flag: "../../tmp/pam", wantErr: true},
+	} {
+		pamServiceFlag = tt.flag
+
+		c := Config{PAMService: "polkit-1-custom", PAMServiceRemote: "sshd-custom"}
+		err := applyPAMServiceFlag(&c)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("--pam-service %q accepted", tt.flag)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("--pam-service %q refused: %v", tt.flag, err)
+		}
+		if c.PAMService != tt.want {
+			t.Errorf("--pam-service %q set %q, want %q", tt.flag, c.PAMService, tt.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// dedupEntry is an authentication that later requests for the same action
+// and user can wait for instead of prompting again.
+type dedupEntry struct {
+	started time.Time
+	done    chan struct{}
+	err     *dbus.Error
+}
+
+// dedupRequests tracks authentications by action id and user.
+type dedupRequests struct {
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+// dedupKey identifies identical requests: the same action for the same
+// user, asked for by the same subject with the same message and details.
+// Requests of another process, f.e. a second pkexec, never share a result.
+func dedupKey(actionId, userName, message string, details map[string]string) string {
+	parts := []string{actionId, userName, message}
+	for _, k := range slices.Sorted(maps.Keys(details)) {
+		parts = append(parts, k+"="+details[k])
+	}
+
+	return strings.Join(parts, "\x00")
+}
+
+// join returns the entry for key when it was started within
+// dedup_window_ms and is still in flight, a finished authentication is
+// never handed out again. Otherwise a new entry is created and leader is
+// true; the caller then has to authenticate and finish the entry.
+func (d *dedupRequests) join(key string) (entry *dedupEntry, leader bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	window := time.Duration(conf().DedupWindowMs) * time.Millisecond
+
+	if d.entries == nil {
+		d.entries = make(map[string]*dedupEntry)
+	}
+
+	for k, e := range d.entries {
+		if e.finished() {
+			delete(d.entries, k)
+		}
+	}
+
+	if e, ok := d.entries[key]; ok && time.Since(e.started) < window {
+		return e, false
+	}
+
+	entry = &dedupEntry{
+		started: time.Now(),
+		done:    make(chan struct{}),
+	}
+	d.entries[key] = entry
+
+	return entry, true
+}
+
+// finish publishes the result of the leader's authentication.
+func (e *dedupEntry) finish(err *dbus.Error) {
+	e.err = err
+	close(e.done)
+}
+
+// finishDeferred is deferred by the leader and finishes e with *dbusErr. A
+// panic is recovered further up, after this ran with *dbusErr still unset,
+// so then the waiting requests are failed before the panic continues.
+func (e *dedupEntry) finishDeferred(dbusErr **dbus.Error) {
+	if r := recover(); r != nil {
+		e.finish(dbus.MakeFailedError(errInternal))
+		panic(r)
+	}
+
+	e.finish(*dbusErr)
+}
+
+func (e *dedupEntry) finished() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait blocks until the leader is done and returns its result. It returns
+// ctx's error instead when the waiting request is cancelled or times out
+// first.
+func (e *dedupEntry) wait(ctx context.Context) (*dbus.Error, error) {
+	infof("Waiting for the authentication started %s ago", time.Since(e.started).Round(time.Millisecond))
+
+	select {
+	case <-e.done:
+		return e.err, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestDedupWait(t *testing.T) {
+	old := conf()
+	t.Cleanup(func() { config.Store(old) })
+	updateConfig(func(c *Config) { c.DedupWindowMs = 60000 })
+
+	var d dedupRequests
+
+	leader, ok := d.join("action\x00alice")
+	if !ok {
+		t.Fatalf("first request isn't the leader")
+	}
+
+	follower, ok := d.join("action\x00alice")
+	if ok || follower != leader {
+		t.Fatalf("second request didn't join the first")
+	}
+
+	if _, ok := d.join("action\x00bob"); !ok {
+		t.Fatalf("request of another user joined")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := follower.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled wait returned %v, want context.Canceled", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err := follower.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("timed out wait returned %v, want context.DeadlineExceeded", err)
+	}
+
+	failed := dbus.MakeFailedError(errInternal)
+	leader.finish(failed)
+
+	result, err := follower.wait(context.Background())
+	if err != nil || result != failed {
+		t.Errorf("wait() = %v, %v, want the leader's result", result, err)
+	}
+
+	if _, ok := d.join("action\x00alice"); !ok {
+		t.Errorf("request joined a finished authentication")
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	details := map[string]string{"polkit.subject-pid": "100", "polkit.caller-pid": "100"}
+	key := dedupKey("org.freedesktop.policykit.exec", "alice", "Run id", details)
+
+	same := map[string]string{"polkit.caller-pid": "100", "polkit.subject-pid": "100"}
+	if dedupKey("org.freedesktop.policykit.exec", "alice", "Run id", same) != key {
+		t.Errorf("identical requests got different keys")
+	}
+
+	other := map[string]string{"polkit.subject-pid": "200", "polkit.caller-pid": "200"}
+	for name, k := range map[string]string{
+		"other process": dedupKey("org.freedesktop.policykit.exec", "alice", "Run id", other),
+		"other message": dedupKey("org.freedesktop.policykit.exec", "alice", "Run rm", details),
+		"other user":    dedupKey("org.freedesktop.policykit.exec", "bob", "Run id", details),
+		"other action":  dedupKey("org.example.a", "alice", "Run id", details),
+	} {
+		if k == key {
+			t.Errorf("%s got the same key", name)
+		}
+	}
+}
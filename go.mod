@@ -3,6 +3,7 @@ module github.com/abenz1267/wpka
 go 1.23.4
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/godbus/dbus/v5 v5.1.0
 	github.com/msteinert/pam v1.2.0
 )
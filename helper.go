@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/msteinert/pam"
+)
+
+// polkitHelperPaths are where distributions install polkit's setuid helper.
+var polkitHelperPaths = []string{
+	"/usr/lib/polkit-1/polkit-agent-helper-1",
+	"/usr/libexec/polkit-agent-helper-1",
+	"/usr/lib/policykit-1/polkit-agent-helper-1",
+}
+
+// errHelperUnavailable is returned by helperAuth when the helper can't be
+// run at all, which is not a failed attempt of the user.
+var errHelperUnavailable = errors.New("polkit-agent-helper-1 is not available")
+
+// polkitHelper returns the path of polkit-agent-helper-1, polkit_helper
+// when set.
+func polkitHelper() (string, error) {
+	if p := conf().PolkitHelper; p != "" {
+		return p, nil
+	}
+
+	for _, p := range polkitHelperPaths {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w, set polkit_helper", errHelperUnavailable)
+}
+
+// helperStyles are the prefixes the helper puts before PAM's messages.
+var helperStyles = []struct {
+	prefix string
+	style  pam.Style
+}{
+	{"PAM_PROMPT_ECHO_OFF ", pam.PromptEchoOff},
+	{"PAM_PROMPT_ECHO_ON ", pam.PromptEchoOn},
+	{"PAM_ERROR_MSG ", pam.ErrorMsg},
+	{"PAM_TEXT_INFO ", pam.TextInfo},
+}
+
+// helperMessage parses a line of the helper's output into a PAM message.
+func helperMessage(line string) (pam.Style, string, bool) {
+	for _, s := range helperStyles {
+		if msg, ok := strings.CutPrefix(line, s.prefix); ok {
+			return s.style, unescapeHelper(msg), true
+		}
+	}
+
+	return 0, "", false
+}
+
+// unescapeHelper undoes the C escapes (g_strescape) the helper uses to keep
+// a message on one line.
+func unescapeHelper(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		switch c := s[i]; c {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			v := 0
+			for n := 0; n < 3 && i < len(s) && s[i] >= '0' && s[i] <= '7'; n++ {
+				v = v*8 + int(s[i]-'0')
+				i++
+			}
+			i--
+			b.WriteByte(byte(v))
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// helperAuth authenticates userName for cookie with polkit-agent-helper-1,
+// the way agents not running as root do. The setuid helper checks the
+// password with the polkit-1 PAM service and sends polkit the response
+// itself. Its PAM messages are answered like PAMAuth's, with h.
+func helperAuth(ctx context.Context, userName, cookie string, h pamHandlers) error {
+	path, err := polkitHelper()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, path, userName)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errHelperUnavailable, err)
+	}
+	defer stdin.Close()
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("%w: %v", errHelperUnavailable, err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("%w: %v", errHelperUnavailable, err)
+	}
+
+	c := &pamConversation{userName: userName, h: h}
+	defer func() { wipe(c.passwd) }()
+
+	// the cookie goes to stdin, other users could read it from argv
+	result := fmt.Errorf("%s exited without a result", path)
+	if _, err := fmt.Fprintf(stdin, "%s\n", cookie); err != nil {
+		result = fmt.Errorf("failed to send the cookie to %s: %w", path, err)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if line == "SUCCESS" || line == "FAILURE" {
+			if line == "SUCCESS" {
+				result = nil
+			} else {
+				result = errors.New("authentication failed")
+			}
+			break
+		}
+
+		style, msg, ok := helperMessage(line)
+		if !ok {
+			debugf("Ignoring unexpected output of %s", path)
+			continue
+		}
+
+		reply, err := c.respond(style, msg)
+		if err != nil {
+			break
+		}
+
+		if style != pam.PromptEchoOff && style != pam.PromptEchoOn {
+			continue
+		}
+
+		// the helper reads one line per answer
+		if strings.ContainsAny(reply, "\n\x00") {
+			c.err = errors.New("answer contains a newline")
+			break
+		}
+
+		buf := append([]byte(reply), '\n')
+		_, err = stdin.Write(buf)
+		wipe(buf)
+		if err != nil {
+			break
+		}
+	}
+
+	if c.err != nil || result != nil {
+		// nothing more to answer, a helper waiting for one is killed
+		cmd.Process.Kill()
+	}
+	stdin.Close()
+	waitErr := cmd.Wait()
+
+	if c.err != nil {
+		return c.err
+	}
+	if result == nil && waitErr != nil {
+		return waitErr
+	}
+
+	return result
+}
+
+// applyUnprivileged turns off what needs wpka to run as root. Without root
+// only the helper can answer polkit, and it does so only after checking a
+// password, always with the polkit-1 PAM service.
+func applyUnprivileged(c *Config) {
+	for _, k := range []struct {
+		key string
+		set bool
+		off func()
+	}{
+		{"trusted_actions", len(c.TrustedActions) > 0, func() { c.TrustedActions = nil }},
+		{"cache_duration", c.CacheDuration > 0, func() { c.CacheDuration = 0 }},
+		{"dedup_window_ms", c.DedupWindowMs > 0, func() { c.DedupWindowMs = 0 }},
+		{"batch_window_ms", c.BatchWindowMs > 0, func() { c.BatchWindowMs = 0 }},
+	} {
+		if k.set {
+			warnf("Ignoring %s, it needs wpka to run as root", k.key)
+			k.off()
+		}
+	}
+
+	if c.PAMService != "polkit-1" || c.PAMServiceRemote != "" {
+		warnf("Ignoring pam_service and pam_service_remote, polkit-agent-helper-1 always uses polkit-1")
+	}
+
+	if c.OnFailureRunAs == "root" {
+		warnf("on_failure_command runs as the own user, wpka isn't running as root")
+	}
+}
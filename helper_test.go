@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/msteinert/pam"
+)
+
+// fakeHelper installs a polkit_helper script that speaks the helper's
+// protocol: it reads the cookie, asks for a password and a code and succeeds
+// for hunter2 and 123456.
+func fakeHelper(t *testing.T) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "polkit-agent-helper-1")
+	script := `#!/bin/sh
+read -r cookie
+[ "$1" = alice ] && [ "$cookie" = cookie-1 ] || { echo FAILURE; exit 1; }
+echo 'PAM_TEXT_INFO Touch\ your\ttoken'
+echo 'PAM_PROMPT_ECHO_OFF Password: '
+read -r pw
+echo 'PAM_PROMPT_ECHO_ON Verification code: '
+read -r code
+[ "$pw" = hunter2 ] && [ "$code" = 123456 ] && echo SUCCESS || echo FAILURE
+`
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	old := conf()
+	t.Cleanup(func() { config.Store(old) })
+	updateConfig(func(c *Config) { c.PolkitHelper = path })
+}
+
+func TestHelperAuth(t *testing.T) {
+	fakeHelper(t)
+
+	var calls []string
+	c := fakeConversation(&calls)
+
+	if err := helperAuth(context.Background(), "alice", "cookie-1", c.h); err != nil {
+		t.Fatalf("helperAuth() failed: %v", err)
+	}
+
+	want := []string{"message Touch your\ttoken ", "password", "prompt Verification code: "}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("handlers called %q, want %q", calls, want)
+	}
+}
+
+func TestHelperAuthFailure(t *testing.T) {
+	fakeHelper(t)
+
+	var calls []string
+	c := fakeConversation(&calls)
+	c.h.password = func() ([]byte, error) { return []byte("wrong"), nil }
+
+	if err := helperAuth(context.Background(), "alice", "cookie-1", c.h); err == nil {
+		t.Errorf("helperAuth() accepted a wrong password")
+	}
+
+	if err := helperAuth(context.Background(), "alice", "cookie-2", c.h); err == nil {
+		t.Errorf("helperAuth() accepted a wrong cookie")
+	}
+}
+
+func TestHelperAuthPromptError(t *testing.T) {
+	fakeHelper(t)
+
+	var calls []string
+	c := fakeConversation(&calls)
+	c.h.password = func() ([]byte, error) { return nil, errPromptCancelled }
+
+	if err := helperAuth(context.Background(), "alice", "cookie-1", c.h); !errors.Is(err, errPromptCancelled) {
+		t.Errorf("helperAuth() = %v, want errPromptCancelled", err)
+	}
+}
+
+func TestHelperMessage(t *testing.T) {
+	tests := []struct {
+		line  string
+		style pam.Style
+		msg   string
+		ok    bool
+	}{
+		{"PAM_PROMPT_ECHO_OFF Password: ", pam.PromptEchoOff, "Password: ", true},
+		{"PAM_PROMPT_ECHO_ON login:", pam.PromptEchoOn, "login:", true},
+		{`PAM_ERROR_MSG line one\nline two`, pam.ErrorMsg, "line one\nline two", true},
+		{`PAM_TEXT_INFO back\\slash \101\"`, pam.TextInfo, `back\slash A"`, true},
+		{`PAM_TEXT_INFO trailing\`, pam.TextInfo, `trailing\`, true},
+		{"SUCCESS", 0, "", false},
+		{"PAM_PROMPT_ECHO_OFF", 0, "", false},
+	}
+
+	for _, tt := range tests {
+		style, msg, ok := helperMessage(tt.line)
+		if style != tt.style || msg != tt.msg || ok != tt.ok {
+			t.Errorf("helperMessage(%q) = %v, %q, %v, want %v, %q, %v", tt.line, style, msg, ok, tt.style, tt.msg, tt.ok)
+		}
+	}
+}
+
+func TestApplyUnprivileged(t *testing.T) {
+	c := defaultConfig()
+	c.TrustedActions = []string{"org.example.a"}
+	c.CacheDuration = 300
+	c.DedupWindowMs = 500
+	c.BatchWindowMs = 500
+
+	applyUnprivileged(&c)
+
+	if c.TrustedActions != nil || c.CacheDuration != 0 || c.DedupWindowMs != 0 || c.BatchWindowMs != 0 {
+		t.Errorf("applyUnprivileged() kept settings that need root: %+v", c)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Command is a configured command. An array is executed directly, a string
+// is run through sh -c.
+type Command struct {
+	Args  []string
+	Shell bool
+}
+
+// UnmarshalTOML implements toml.Unmarshaler.
+func (c *Command) UnmarshalTOML(v any) error {
+	*c = Command{}
+
+	switch v := v.(type) {
+	case string:
+		c.Shell = true
+		c.Args = []string{v}
+	case []any:
+		c.Args = make([]string, 0, len(v))
+
+		for _, arg := range v {
+			s, ok := arg.(string)
+			if !ok {
+				return fmt.Errorf("command arguments must be strings, got %T", arg)
+			}
+			c.Args = append(c.Args, s)
+		}
+	default:
+		return fmt.Errorf("command must be a string or an array of strings, got %T", v)
+	}
+
+	return nil
+}
+
+// Empty reports whether no command is configured.
+func (c Command) Empty() bool {
+	return len(c.Args) == 0 || c.Args[0] == ""
+}
+
+// Cmd returns the exec.Cmd running c.
+func (c Command) Cmd() *exec.Cmd {
+	if c.Shell {
+		return exec.Command("sh", "-c", c.Args[0])
+	}
+
+	return exec.Command(c.Args[0], c.Args[1:]...)
+}
+
+// asInvokingUser makes cmd run as the user that invoked sudo. It does
+// nothing when not running as root. When the user can't be determined cmd
+// must not be started, it would run as root.
+func asInvokingUser(cmd *exec.Cmd) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+
+	u, err := getCurrentUser()
+	if err != nil {
+		return fmt.Errorf("failed to get the invoking user: %w", err)
+	}
+
+	cred, err := userCredential(u)
+	if err != nil {
+		return fmt.Errorf("failed to get credentials of %s: %w", u.Username, err)
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("HOME=%s", u.HomeDir),
+		fmt.Sprintf("USER=%s", u.Username),
+	)
+
+	return nil
+}
+
+// userCredential returns the credential to run a process as u, including
+// u's supplementary groups when they can be looked up.
+func userCredential(u *user.User) (*syscall.Credential, error) {
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+
+	groups, err := u.GroupIds()
+	if err != nil {
+		// fewer groups never grant more than intended
+		warnf("Failed to lookup groups of %s, running without them: %v", u.Username, err)
+	}
+
+	for _, g := range groups {
+		id, err := strconv.ParseUint(g, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		cred.Groups = append(cred.Groups, uint32(id))
+	}
+
+	return cred, nil
+}
+
+// runHook starts a configured hook command without waiting for it. When
+// running under sudo the hook runs as the invoking user.
+func runHook(name string, command Command, env ...string) {
+	runHookAs(name, command, true, env...)
+}
+
+// runHookAs is runHook, asUser false keeps the hook running as root.
+func runHookAs(name string, command Command, asUser bool, env ...string) {
+	if command.Empty() {
+		return
+	}
+
+	cmd := command.Cmd()
+	cmd.Env = append(os.Environ(), env...)
+
+	if asUser {
+		if err := asInvokingUser(cmd); err != nil {
+			warnf("Not running %s: %v", name, err)
+			return
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		warnf("Failed to run %s: %v", name, err)
+		return
+	}
+
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			infof("%s failed: %v", name, err)
+		}
+	}()
+}
+
+// promptHookTimeout limits how long a prompt hook may delay the prompt.
+const promptHookTimeout = 5 * time.Second
+
+// runPromptHook runs a hook around the prompt and waits for it, at most
+// promptHookTimeout. It gets the prompt's environment env and runs with
+// its credential cred, nil keeps wpka's.
+func runPromptHook(name string, command Command, env []string, cred *syscall.Credential) {
+	if command.Empty() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), promptHookTimeout)
+	defer cancel()
+
+	cmd := command.Cmd()
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+
+	if err := cmd.Start(); err != nil {
+		warnf("Failed to run %s: %v", name, err)
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			infof("%s failed: %v", name, err)
+		}
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		warnf("%s did not finish within %s, killed it", name, promptHookTimeout)
+		<-done
+	}
+}
+
+// notifyFailure sends a desktop notification that authentication for
+// action failed, as the invoking user on their session bus. It doesn't wait
+// for notify-send.
+func notifyFailure(action string) {
+	u, err := getCurrentUser()
+	if err != nil {
+		warnf("Failed to notify about the failure: %v", err)
+		return
+	}
+
+	vars, err := cachedOriginalEnv(u.Username)
+	if err != nil {
+		warnf("Failed to notify about the failure: %v", err)
+		return
+	}
+
+	cmd := exec.Command("notify-send", "--app-name=wpka", "--icon=dialog-error",
+		"Authentication failed", fmt.Sprintf("Authentication for %s failed", action))
+
+	for k, v := range vars {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	if _, ok := vars["DBUS_SESSION_BUS_ADDRESS"]; !ok {
+		if addr, ok := defaultSessionBus(userRuntimeDir(vars, u.Uid)); ok {
+			cmd.Env = append(cmd.Env, "DBUS_SESSION_BUS_ADDRESS="+addr)
+		}
+	}
+
+	if err := asInvokingUser(cmd); err != nil {
+		warnf("Failed to notify about the failure: %v", err)
+		return
+	}
+
+	if err := cmd.Start(); err != nil {
+		warnf("Failed to run notify-send: %v", err)
+		return
+	}
+
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			infof("notify-send failed: %v", err)
+		}
+	}()
+}
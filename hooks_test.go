@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestAsInvokingUserFailsClosed(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("only applies when running as root")
+	}
+
+	t.Setenv("SUDO_USER", "")
+
+	cmd := exec.Command("true")
+	if err := asInvokingUser(cmd); err == nil {
+		t.Errorf("asInvokingUser() succeeded without an invoking user")
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Identity is an identity polkit accepts for a request.
+type Identity struct {
+	// Kind is "unix-user" or "unix-group", other kinds are kept but never
+	// match.
+	Kind string
+
+	// ID is the uid of a unix-user or the gid of a unix-group.
+	ID uint32
+}
+
+// parseIdentities decodes the a(sa{sv}) identities of BeginAuthentication.
+func parseIdentities(identities []interface{}) ([]Identity, error) {
+	ids := make([]Identity, 0, len(identities))
+
+	for i, v := range identities {
+		fields, ok := v.([]interface{})
+		if !ok || len(fields) != 2 {
+			return nil, fmt.Errorf("identity %d is not a (sa{sv}) struct", i)
+		}
+
+		kind, ok := fields[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("identity %d has no kind", i)
+		}
+
+		details, ok := fields[1].(map[string]dbus.Variant)
+		if !ok {
+			return nil, fmt.Errorf("identity %d has no details", i)
+		}
+
+		id := Identity{Kind: kind}
+
+		key := ""
+		switch kind {
+		case "unix-user":
+			key = "uid"
+		case "unix-group":
+			key = "gid"
+		}
+
+		if key != "" {
+			if id.ID, ok = details[key].Value().(uint32); !ok {
+				return nil, fmt.Errorf("%s identity %d has no %s", kind, i, key)
+			}
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// chooseIdentity picks the user to authenticate among the identities
+// polkit accepts: the session owner when allowed, directly or as member of
+// a unix-group, else the first unix-user. Other members of a group are
+// never picked, they aren't the one sitting in front of the session.
+func chooseIdentity(ids []Identity, owner *user.User) (*user.User, error) {
+	if owner != nil && identityAllowed(ids, owner) {
+		return owner, nil
+	}
+
+	for _, id := range ids {
+		if id.Kind != "unix-user" {
+			continue
+		}
+
+		u, err := user.LookupId(strconv.FormatUint(uint64(id.ID), 10))
+		if err != nil {
+			warnf("Failed to lookup uid %d: %v", id.ID, err)
+			continue
+		}
+
+		return u, nil
+	}
+
+	if owner == nil {
+		return nil, fmt.Errorf("none of the identities polkit accepts can be authenticated")
+	}
+
+	if groups := groupNames(ids); len(groups) > 0 {
+		return nil, fmt.Errorf("user %s is not a member of %s", owner.Username, strings.Join(groups, " or "))
+	}
+
+	return nil, fmt.Errorf("user %s can't authenticate for this action", owner.Username)
+}
+
+// groupNames returns the names of the unix-group identities, or their gid
+// when the group can't be looked up.
+func groupNames(ids []Identity) []string {
+	var names []string
+
+	for _, id := range ids {
+		if id.Kind != "unix-group" {
+			continue
+		}
+
+		gid := strconv.FormatUint(uint64(id.ID), 10)
+		if g, err := user.LookupGroupId(gid); err == nil {
+			names = append(names, g.Name)
+		} else {
+			names = append(names, gid)
+		}
+	}
+
+	return names
+}
+
+// identityAllowed reports whether u matches one of the identities polkit
+// accepts, either as unix-user or as member of a unix-group.
+func identityAllowed(ids []Identity, u *user.User) bool {
+	groups, err := u.GroupIds()
+	if err != nil {
+		warnf("Failed to lookup groups of %s: %v", u.Username, err)
+	}
+
+	for _, id := range ids {
+		switch id.Kind {
+		case "unix-user":
+			if strconv.FormatUint(uint64(id.ID), 10) == u.Uid {
+				return true
+			}
+		case "unix-group":
+			for _, g := range groups {
+				if g == strconv.FormatUint(uint64(id.ID), 10) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// authKind tells whether the user authenticates as themselves ("self") or
+// as an administrator ("admin"). polkit doesn't send the implicit
+// authorization, but for auth_self it only offers the requesting user while
+// auth_admin offers the admin users and groups. So only unix-user
+// identities of uid mean "self".
+func authKind(ids []Identity, uid string) string {
+	if len(ids) == 0 {
+		return "admin"
+	}
+
+	for _, id := range ids {
+		if id.Kind != "unix-user" || strconv.FormatUint(uint64(id.ID), 10) != uid {
+			return "admin"
+		}
+	}
+
+	return "self"
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// polkitIdentity is an identity as polkit sends it, a (sa{sv}) struct.
+type polkitIdentity struct {
+	Kind    string
+	Details map[string]dbus.Variant
+}
+
+// marshalIdentities sends identities through godbus' wire format and
+// decodes them the way an exported method receives its a(sa{sv}) argument.
+func marshalIdentities(t *testing.T, identities []polkitIdentity) []interface{} {
+	t.Helper()
+
+	msg := &dbus.Message{
+		Type: dbus.TypeMethodCall,
+		Headers: map[dbus.HeaderField]dbus.Variant{
+			dbus.FieldPath:   dbus.MakeVariant(dbus.ObjectPath(agentPath)),
+			dbus.FieldMember: dbus.MakeVariant("BeginAuthentication"),
+		},
+		Body: []interface{}{identities},
+	}
+	msg.Headers[dbus.FieldSignature] = dbus.MakeVariant(dbus.SignatureOf(identities))
+
+	var buf bytes.Buffer
+	if err := msg.EncodeTo(&buf, binary.LittleEndian); err != nil {
+		t.Fatalf("failed to encode identities: %v", err)
+	}
+
+	decoded, err := dbus.DecodeMessage(&buf)
+	if err != nil {
+		t.Fatalf("failed to decode identities: %v", err)
+	}
+
+	var res []interface{}
+	if err := dbus.Store(decoded.Body, &res); err != nil {
+		t.Fatalf("failed to store identities: %v", err)
+	}
+
+	return res
+}
+
+func TestParseIdentities(t *testing.T) {
+	tests := []struct {
+		name       string
+		identities []polkitIdentity
+		want       []Identity
+		wantErr    bool
+	}{
+		{
+			name:       "none",
+			identities: []polkitIdentity{},
+			want:       []Identity{},
+		},
+		{
+			name: "user",
+			identities: []polkitIdentity{
+				{"unix-user", map[string]dbus.Variant{"uid": dbus.MakeVariant(uint32(1000))}},
+			},
+			want: []Identity{{Kind: "unix-user", ID: 1000}},
+		},
+		{
+			name: "user and group",
+			identities: []polkitIdentity{
+				{"unix-user", map[string]dbus.Variant{"uid": dbus.MakeVariant(uint32(0))}},
+				{"unix-group", map[string]dbus.Variant{"gid": dbus.MakeVariant(uint32(10))}},
+			},
+			want: []Identity{{Kind: "unix-user", ID: 0}, {Kind: "unix-group", ID: 10}},
+		},
+		{
+			name: "netgroup is kept",
+			identities: []polkitIdentity{
+				{"unix-netgroup", map[string]dbus.Variant{"name": dbus.MakeVariant("admins")}},
+			},
+			want: []Identity{{Kind: "unix-netgroup"}},
+		},
+		{
+			name: "user without uid",
+			identities: []polkitIdentity{
+				{"unix-user", map[string]dbus.Variant{}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "group with uid instead of gid",
+			identities: []polkitIdentity{
+				{"unix-group", map[string]dbus.Variant{"uid": dbus.MakeVariant(uint32(10))}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "uid of the wrong type",
+			identities: []polkitIdentity{
+				{"unix-user", map[string]dbus.Variant{"uid": dbus.MakeVariant("1000")}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "malformed after a valid one",
+			identities: []polkitIdentity{
+				{"unix-user", map[string]dbus.Variant{"uid": dbus.MakeVariant(uint32(1000))}},
+				{"unix-user", map[string]dbus.Variant{"uid": dbus.MakeVariant(int32(1000))}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, err := parseIdentities(marshalIdentities(t, tt.identities))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseIdentities() = %v, want an error", ids)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseIdentities() failed: %v", err)
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("parseIdentities() = %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+// TestParseIdentitiesMalformed covers values that don't have the a(sa{sv})
+// signature at all, godbus can't produce them from a valid message.
+func TestParseIdentitiesMalformed(t *testing.T) {
+	for name, identities := range map[string][]interface{}{
+		"not a struct":      {"unix-user"},
+		"too few fields":    {[]interface{}{"unix-user"}},
+		"kind not a string": {[]interface{}{uint32(1), map[string]dbus.Variant{}}},
+		"details not a map": {[]interface{}{"unix-user", "1000"}},
+	} {
+		if ids, err := parseIdentities(identities); err == nil {
+			t.Errorf("%s: parseIdentities() = %v, want an error", name, ids)
+		}
+	}
+}
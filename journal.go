@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// journalSocket is where journald receives native protocol messages.
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalHandler is a slog.Handler writing to journald's native socket, so
+// each entry gets a PRIORITY matching its level.
+type journalHandler struct {
+	conn  *net.UnixConn
+	level slog.Leveler
+	attrs []slog.Attr
+
+	// mu serializes writes to conn
+	mu *sync.Mutex
+}
+
+// newJournalHandler connects to journald. It fails when wpka doesn't run
+// under systemd.
+func newJournalHandler(level slog.Leveler) (*journalHandler, error) {
+	if os.Getenv("JOURNAL_STREAM") == "" && os.Getenv("INVOCATION_ID") == "" {
+		return nil, fmt.Errorf("not running under systemd")
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	return &journalHandler{conn: conn, level: level, mu: &sync.Mutex{}}, nil
+}
+
+func (h *journalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *journalHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+
+	writeJournalField(&buf, "PRIORITY", journalPriority(r.Level))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", "wpka")
+	writeJournalField(&buf, "MESSAGE", r.Message)
+
+	for _, a := range h.attrs {
+		writeJournalField(&buf, journalKey(a.Key), a.Value.String())
+	}
+
+	r.Attrs(func(a slog.Attr) bool {
+		writeJournalField(&buf, journalKey(a.Key), a.Value.String())
+		return true
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, err := h.conn.Write(buf.Bytes())
+	return err
+}
+
+func (h *journalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &c
+}
+
+// WithGroup is not supported by the journal's flat fields, attributes keep
+// their own names.
+func (h *journalHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// journalPriority maps level to a syslog priority.
+func journalPriority(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "3"
+	case level >= slog.LevelWarn:
+		return "4"
+	case level >= slog.LevelInfo:
+		return "6"
+	}
+
+	return "7"
+}
+
+// journalKey turns key into a valid journal field name: uppercase letters,
+// digits and underscores, not starting with an underscore.
+func journalKey(key string) string {
+	key = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+
+	return "WPKA_" + strings.TrimLeft(key, "_")
+}
+
+// writeJournalField appends a field in the native protocol. Values with a
+// newline use the binary form with an explicit length.
+func writeJournalField(buf *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", key, value)
+		return
+	}
+
+	buf.WriteString(key)
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
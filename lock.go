@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// errLocked is returned by acquireLock when another instance holds the lock.
+var errLocked = errors.New("another instance holds the lock")
+
+// stateDir returns the directory for wpka's runtime state. As root it is
+// always /run/wpka, XDG_RUNTIME_DIR may have been set by the invoking user.
+// Otherwise it is below XDG_RUNTIME_DIR.
+func stateDir() string {
+	if os.Geteuid() == 0 {
+		return "/run/wpka"
+	}
+
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = filepath.Join("/run/user", strconv.Itoa(os.Geteuid()))
+	}
+
+	return filepath.Join(dir, "wpka")
+}
+
+// checkStateDir makes sure dir is a directory, not a symlink, that only
+// wpka's own user can modify. Otherwise someone else could plant files in
+// it that wpka would overwrite or remove.
+func checkStateDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || int(st.Uid) != os.Geteuid() {
+		return fmt.Errorf("%s is not owned by uid %d (owner %s)", dir, os.Geteuid(), fileOwner(info))
+	}
+
+	if info.Mode().Perm()&0o022 != 0 {
+		return fmt.Errorf("%s is writable by group or others (mode %s)", dir, info.Mode().Perm())
+	}
+
+	return nil
+}
+
+// instanceLock is the lock file held while the agent runs. It contains the
+// pid of its owner, the lock itself is released by the kernel when the
+// process dies.
+type instanceLock struct {
+	file *os.File
+}
+
+// acquireLock takes the lock in dir and writes the own pid to it. A pid
+// left in an unlocked file means the previous instance crashed, then the
+// other files in dir are stale and are removed when clean is set.
+func acquireLock(dir string, clean bool) (*instanceLock, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	if err := checkStateDir(dir); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, "wpka.lock"), os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errLocked
+		}
+
+		return nil, err
+	}
+
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+
+	if pid := strings.TrimSpace(string(buf[:n])); pid != "" {
+		infof("Previous instance (pid %s) did not exit cleanly", pid)
+
+		if clean {
+			cleanStateDir(dir)
+		}
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &instanceLock{file: f}, nil
+}
+
+// lockOwner returns the pid written to the lock file in dir.
+func lockOwner(dir string) (int, error) {
+	b, err := os.ReadFile(filepath.Join(dir, "wpka.lock"))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// cleanStateDir removes everything in dir except the lock file.
+func cleanStateDir(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		warnf("Failed to read %s: %v", dir, err)
+		return
+	}
+
+	for _, e := range entries {
+		if e.Name() == "wpka.lock" {
+			continue
+		}
+
+		path := filepath.Join(dir, e.Name())
+		if err := os.RemoveAll(path); err != nil {
+			warnf("Failed to remove stale %s: %v", path, err)
+		} else {
+			infof("Removed stale %s", path)
+		}
+	}
+}
+
+// release clears the pid, marking a clean exit, and unlocks.
+func (l *instanceLock) release() {
+	if err := l.file.Truncate(0); err != nil {
+		warnf("Failed to clear lock file: %v", err)
+	}
+
+	l.file.Close()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcquireLock(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wpka")
+
+	l, err := acquireLock(dir, true)
+	if err != nil {
+		t.Fatalf("acquireLock() failed: %v", err)
+	}
+
+	if pid, err := lockOwner(dir); err != nil || pid != os.Getpid() {
+		t.Errorf("lockOwner() = %d, %v, want %d", pid, err, os.Getpid())
+	}
+
+	l.release()
+}
+
+func TestAcquireLockRefusesSymlink(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wpka")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	target := filepath.Join(t.TempDir(), "target")
+	if err := os.WriteFile(target, []byte("keep"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, filepath.Join(dir, "wpka.lock")); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err := acquireLock(dir, true); err == nil {
+		l.release()
+		t.Errorf("acquireLock() followed a symlinked lock file")
+	}
+
+	if b, _ := os.ReadFile(target); string(b) != "keep" {
+		t.Errorf("symlink target was modified: %q", b)
+	}
+}
+
+func TestAcquireLockRefusesUnsafeDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wpka")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := filepath.Join(dir, "stale")
+	if err := os.WriteFile(stale, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err := acquireLock(dir, true); err == nil {
+		l.release()
+		t.Errorf("acquireLock() accepted a world-writable directory")
+	}
+
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("files in the unsafe directory were removed: %v", err)
+	}
+
+	link := filepath.Join(t.TempDir(), "link")
+	if err := os.Symlink(dir, link); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkStateDir(link); err == nil {
+		t.Errorf("checkStateDir() accepted a symlink")
+	}
+}
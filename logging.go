@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+)
+
+// logLevel is the minimum level that is logged.
+var logLevel slog.LevelVar
+
+// setupLogger switches the log output to the given format. Plain text keeps
+// the standard logger, json, logfmt and journal route it through the
+// matching slog handler. Without systemd journal falls back to text.
+func setupLogger(format string) {
+	opts := &slog.HandlerOptions{Level: &logLevel}
+
+	switch format {
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	case "logfmt":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "journal":
+		h, err := newJournalHandler(&logLevel)
+		if err != nil {
+			updateConfig(func(c *Config) { c.LogFormat = "text" })
+			infof("Logging to stderr, journal unavailable: %v", err)
+			return
+		}
+
+		slog.SetDefault(slog.New(h))
+	}
+}
+
+// setLogLevel changes the minimum level that is logged.
+func setLogLevel(level slog.Level) {
+	logLevel.Set(level)
+
+	if conf().LogFormat == "text" {
+		slog.SetLogLoggerLevel(level)
+	}
+}
+
+// logLevelFromArgs returns the level given by --log-level, or else by
+// WPKA_LOG_LEVEL. It defaults to info.
+func logLevelFromArgs() (slog.Level, error) {
+	value := os.Getenv("WPKA_LOG_LEVEL")
+
+	if v, ok := takeFlag("--log-level"); ok {
+		value = v
+	}
+
+	var level slog.Level
+	if value == "" {
+		return slog.LevelInfo, nil
+	}
+
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return slog.LevelInfo, fmt.Errorf("invalid log level %q, use debug, info, warn or error", value)
+	}
+
+	return level, nil
+}
+
+// logf logs at level. The standard logger used for plain text knows no
+// levels, so they are checked here and warnings and errors get a prefix.
+func logf(level slog.Level, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+
+	if conf().LogFormat != "text" {
+		slog.Log(context.Background(), level, msg)
+		return
+	}
+
+	if level < logLevel.Level() {
+		return
+	}
+
+	switch {
+	case level >= slog.LevelError:
+		msg = "ERROR: " + msg
+	case level >= slog.LevelWarn:
+		msg = "WARNING: " + msg
+	}
+
+	log.Print(msg)
+}
+
+func debugf(format string, args ...any) { logf(slog.LevelDebug, format, args...) }
+
+func infof(format string, args ...any) { logf(slog.LevelInfo, format, args...) }
+
+func warnf(format string, args ...any) { logf(slog.LevelWarn, format, args...) }
+
+func errorf(format string, args ...any) { logf(slog.LevelError, format, args...) }
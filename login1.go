@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	login1Name    = "org.freedesktop.login1"
+	login1Path    = "/org/freedesktop/login1"
+	login1Manager = "org.freedesktop.login1.Manager"
+	login1Session = "org.freedesktop.login1.Session"
+)
+
+// login1Entry is a session as listed by ListSessions, a (susso) struct.
+type login1Entry struct {
+	ID   string
+	UID  uint32
+	User string
+	Seat string
+	Path dbus.ObjectPath
+}
+
+// getLogindSession asks logind for the session wpka runs in, or else picks
+// one of the user's sessions. elogind implements the same interface, so both
+// backends use it.
+func getLogindSession(backend string) (string, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to system bus: %w", err)
+	}
+
+	manager := conn.Object(login1Name, login1Path)
+
+	var path dbus.ObjectPath
+	if err := manager.Call(login1Manager+".GetSessionByPID", 0, uint32(os.Getpid())).Store(&path); err == nil {
+		if id, err := conn.Object(login1Name, path).GetProperty(login1Session + ".Id"); err == nil {
+			if id, ok := id.Value().(string); ok {
+				return id, nil
+			}
+		}
+	}
+
+	var sessions []login1Entry
+	if err := manager.Call(login1Manager+".ListSessions", 0).Store(&sessions); err != nil {
+		return "", fmt.Errorf("failed to list sessions, is %s running? %w", backend, err)
+	}
+
+	if len(sessions) == 0 {
+		return "", fmt.Errorf("no session found")
+	}
+
+	return pickSession(conn, sessions)
+}
+
+// pickSession prefers an active graphical session of the invoking user,
+// then any graphical one of theirs, then any of theirs. A greeter or tty
+// session listed first would never show the prompt. Sessions of other
+// users, f.e. the greeter's, are never picked.
+func pickSession(conn *dbus.Conn, sessions []login1Entry) (string, error) {
+	u, err := getCurrentUser()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine whose session to use: %w", err)
+	}
+
+	var own []login1Entry
+	for _, s := range sessions {
+		if strconv.FormatUint(uint64(s.UID), 10) == u.Uid {
+			own = append(own, s)
+		}
+	}
+
+	if len(own) == 0 {
+		return "", fmt.Errorf("no session of %s found", u.Username)
+	}
+
+	best, bestScore := own[0].ID, -1
+
+	for _, s := range own {
+		obj := conn.Object(login1Name, s.Path)
+
+		score := 0
+		if v, err := obj.GetProperty(login1Session + ".Type"); err == nil {
+			if t, _ := v.Value().(string); t == "wayland" || t == "x11" {
+				score += 2
+			}
+		}
+		if v, err := obj.GetProperty(login1Session + ".State"); err == nil {
+			if state, _ := v.Value().(string); state == "active" {
+				score++
+			}
+		}
+
+		if score > bestScore {
+			best, bestScore = s.ID, score
+		}
+	}
+
+	return best, nil
+}
+
+// sessionProperty returns the property name of the logind session id.
+func sessionProperty(id, name string) (dbus.Variant, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return dbus.Variant{}, err
+	}
+
+	var path dbus.ObjectPath
+	if err := conn.Object(login1Name, login1Path).Call(login1Manager+".GetSession", 0, id).Store(&path); err != nil {
+		return dbus.Variant{}, err
+	}
+
+	return conn.Object(login1Name, path).GetProperty(login1Session + "." + name)
+}
+
+// sessionUID returns the uid of the user owning the logind session id.
+func sessionUID(id string) (uint32, error) {
+	v, err := sessionProperty(id, "User")
+	if err != nil {
+		return 0, err
+	}
+
+	// User is a (uo) struct of the uid and the user's object path
+	fields, ok := v.Value().([]interface{})
+	if !ok || len(fields) != 2 {
+		return 0, fmt.Errorf("unexpected User property %v", v)
+	}
+
+	uid, ok := fields[0].(uint32)
+	if !ok {
+		return 0, fmt.Errorf("unexpected User property %v", v)
+	}
+
+	return uid, nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestPickSessionRefusesOtherUsers(t *testing.T) {
+	t.Setenv("SUDO_USER", "root")
+
+	// the greeter's session, no session of root
+	sessions := []login1Entry{{ID: "c1", UID: 967, User: "greeter", Path: "/org/freedesktop/login1/session/c1"}}
+
+	if id, err := pickSession(nil, sessions); err == nil {
+		t.Errorf("pickSession() = %s, want an error", id)
+	}
+
+	t.Setenv("SUDO_USER", "")
+
+	if id, err := pickSession(nil, sessions); err == nil {
+		t.Errorf("pickSession() without a user = %s, want an error", id)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const managementInterface = "dev.benz.wpka.Management"
+
+// Management exposes runtime settings over D-Bus. Settings are readable by
+// anyone, changing them requires root. Security-critical settings like
+// commands, hooks and trusted actions are neither exposed nor changeable.
+type Management struct {
+	conn *dbus.Conn
+}
+
+// GetConfig returns the non-sensitive settings.
+func (m *Management) GetConfig() (map[string]dbus.Variant, *dbus.Error) {
+	return map[string]dbus.Variant{
+		"log_level":            dbus.MakeVariant(logLevel.Level().String()),
+		"log_format":           dbus.MakeVariant(conf().LogFormat),
+		"locale":               dbus.MakeVariant(conf().Locale),
+		"input_mode":           dbus.MakeVariant(conf().InputMode),
+		"session_backend":      dbus.MakeVariant(conf().SessionBackend),
+		"display_wait_seconds": dbus.MakeVariant(int32(conf().DisplayWaitSeconds)),
+		"dedup_window_ms":      dbus.MakeVariant(int32(conf().DedupWindowMs)),
+		"metrics_listen":       dbus.MakeVariant(conf().MetricsListen),
+	}, nil
+}
+
+// SetLogLevel changes the log level: debug, info, warn or error.
+func (m *Management) SetLogLevel(sender dbus.Sender, level string) *dbus.Error {
+	if err := m.authorize(sender); err != nil {
+		return err
+	}
+
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return dbus.MakeFailedError(fmt.Errorf("unknown log level %q", level))
+	}
+
+	setLogLevel(l)
+	infof("Log level set to %s by %s", l, sender)
+
+	return nil
+}
+
+// authorize fails unless sender is connected as root.
+func (m *Management) authorize(sender dbus.Sender) *dbus.Error {
+	var uid uint32
+
+	err := m.conn.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixUser", 0, string(sender)).Store(&uid)
+	if err != nil {
+		return dbus.MakeFailedError(err)
+	}
+
+	if uid != 0 {
+		warnf("Denied management call from %s (uid: %d)", sender, uid)
+		return dbus.NewError("org.freedesktop.DBus.Error.AccessDenied", []interface{}{"only root may change settings"})
+	}
+
+	return nil
+}
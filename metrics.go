@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds in seconds of the request duration
+// histogram.
+var durationBuckets = []float64{1, 2.5, 5, 10, 30, 60, 120}
+
+// metrics counts authentication requests and their outcome.
+type metrics struct {
+	requests atomic.Uint64
+	success  atomic.Uint64
+	failure  atomic.Uint64
+	cancel   atomic.Uint64
+	timeout  atomic.Uint64
+
+	mu      sync.Mutex
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+var stats = metrics{buckets: make([]uint64, len(durationBuckets))}
+
+// observe records the duration of a finished request.
+func (m *metrics) observe(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	seconds := d.Seconds()
+
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			m.buckets[i]++
+		}
+	}
+
+	m.sum += seconds
+	m.count++
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	counters := []struct {
+		name  string
+		help  string
+		value uint64
+	}{
+		{"wpka_requests_total", "Authentication requests received.", m.requests.Load()},
+		{"wpka_success_total", "Successful authentications.", m.success.Load()},
+		{"wpka_failure_total", "Failed authentications.", m.failure.Load()},
+		{"wpka_cancel_total", "Authentications cancelled by polkit or the user.", m.cancel.Load()},
+		{"wpka_timeout_total", "Authentications that timed out.", m.timeout.Load()},
+	}
+
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprint(w, "# HELP wpka_request_duration_seconds Duration of authentication requests.\n")
+	fmt.Fprint(w, "# TYPE wpka_request_duration_seconds histogram\n")
+
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(w, "wpka_request_duration_seconds_bucket{le=\"%g\"} %d\n", bound, m.buckets[i])
+	}
+
+	fmt.Fprintf(w, "wpka_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.count)
+	fmt.Fprintf(w, "wpka_request_duration_seconds_sum %g\n", m.sum)
+	fmt.Fprintf(w, "wpka_request_duration_seconds_count %d\n", m.count)
+}
+
+// serveMetrics exposes the metrics on addr. Only loopback addresses are
+// accepted, a missing host binds to localhost.
+func serveMetrics(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid metrics_listen %q: %v", addr, err)
+	}
+
+	switch host {
+	case "":
+		host = "127.0.0.1"
+	case "localhost":
+	default:
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return fmt.Errorf("metrics_listen must be a loopback address, got %s", host)
+		}
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", &stats)
+
+	go func() {
+		err := http.Serve(listener, mux)
+		infof("Metrics server stopped: %v", err)
+	}()
+
+	infof("Serving metrics on http://%s/metrics", listener.Addr())
+
+	return nil
+}
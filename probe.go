@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// probe runs the registration handshake against polkit, stays registered
+// for a few seconds and unregisters again. The optional argument is the
+// number of seconds to stay registered. It returns the exit code.
+func probe(args []string) int {
+	wait := 5 * time.Second
+
+	if len(args) > 0 {
+		seconds, err := strconv.Atoi(args[0])
+		if err != nil || seconds < 0 {
+			fmt.Printf("Invalid probe duration: %s\n", args[0])
+			return 1
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	step := func(name string, err error) bool {
+		if err != nil {
+			fmt.Printf("%-24s failed: %v\n", name, err)
+			return false
+		}
+
+		fmt.Printf("%-24s ok\n", name)
+		return true
+	}
+
+	conn, err := dbus.SystemBus()
+	if !step("Connect to system bus", err) {
+		return 1
+	}
+	defer conn.Close()
+
+	// only root may own the bus name
+	privileged := os.Geteuid() == 0
+
+	if privileged {
+		reply, err := conn.RequestName(agentBusName, dbus.NameFlagDoNotQueue)
+		if err == nil && reply != dbus.RequestNameReplyPrimaryOwner {
+			err = fmt.Errorf("name already taken")
+		}
+		if !step("Request bus name", err) {
+			return 1
+		}
+	}
+
+	sessionId, err := getCurrentSession()
+	if !step("Detect session", err) {
+		return 1
+	}
+	fmt.Printf("  Session ID: %s\n", sessionId)
+
+	agent := &Agent{conn: conn, session: sessionId}
+	if !step("Export agent", conn.Export(agent, dbus.ObjectPath(agentPath), agentInterface)) {
+		return 1
+	}
+
+	subject, err := agentSubject(sessionId)
+	if !step("Create "+conf().SubjectKind+" subject", err) {
+		return 1
+	}
+
+	if !step("Register agent", registerAgent(conn, subject)) {
+		return 1
+	}
+
+	fmt.Printf("Staying registered for %s\n", wait)
+	time.Sleep(wait)
+
+	if !step("Unregister agent", unregisterAgent(conn, subject)) {
+		return 1
+	}
+
+	if privileged {
+		_, err = conn.ReleaseName(agentBusName)
+		if !step("Release bus name", err) {
+			return 1
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// selfTest runs the prompt and checks the password with PAM for the current
+// user, like a request would, without registering with polkit. It returns
+// the exit code.
+func selfTest() int {
+	step := func(name string, err error) bool {
+		if err != nil {
+			fmt.Printf("%-24s failed: %v\n", name, err)
+			return false
+		}
+
+		fmt.Printf("%-24s ok\n", name)
+		return true
+	}
+
+	u, err := getCurrentUser()
+	if !step("Detect user", err) {
+		return 1
+	}
+	fmt.Printf("  User: %s\n", u.Username)
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err == nil {
+		err = checkUID(uint32(uid), "self")
+	}
+	if !step("Check uid", err) {
+		return 1
+	}
+
+	req := promptRequest{
+		ActionID:   "dev.benz.wpka.test",
+		ActionName: "wpka test",
+		Message:    conf().DefaultMessage,
+		AuthKind:   "self",
+	}
+
+	handlers := pamHandlers{
+		password: func() ([]byte, error) {
+			pw, err := getPassword(req, 1)
+			step("Run prompt", err)
+			return pw, err
+		},
+		prompt: func(msg string) (string, error) {
+			return getCode(req, msg)
+		},
+		secret: func(msg string) (string, error) {
+			return getSecret(req, msg)
+		},
+	}
+
+	if conf().ShowPAMMessages {
+		handlers.message = func(msg string, password []byte) {
+			showPAMMessage(req, msg, password)
+		}
+	}
+
+	fmt.Printf("  PAM service: %s\n", conf().PAMService)
+
+	if !step("Authenticate with PAM", PAMAuth(conf().PAMService, u.Username, handlers)) {
+		return 1
+	}
+
+	return 0
+}
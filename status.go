@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const statusInterface = "dev.benz.wpka.Agent"
+
+// agentStatus lets health checks see that the agent is alive, f.e.
+// "busctl call dev.benz.wpka.PolicyKit1.AuthenticationAgent
+// /org/freedesktop/PolicyKit1/AuthenticationAgent dev.benz.wpka.Agent Ping".
+type agentStatus struct{}
+
+// Ping answers "pong" as long as the agent handles calls.
+func (agentStatus) Ping() (string, *dbus.Error) {
+	return "pong", nil
+}
+
+// agentProperties implements org.freedesktop.DBus.Properties for the
+// read-only properties of the status interface: ActiveRequests, the number
+// of authentications in flight, SessionId, the session the agent is
+// registered for, and LastError, the error of the last failed request.
+type agentProperties struct {
+	agent *Agent
+}
+
+var statusProperties = []string{"ActiveRequests", "SessionId", "LastError"}
+
+func (p agentProperties) Get(iface, name string) (dbus.Variant, *dbus.Error) {
+	if iface != statusInterface {
+		return dbus.Variant{}, dbus.NewError("org.freedesktop.DBus.Error.UnknownInterface", []interface{}{iface})
+	}
+
+	switch name {
+	case "ActiveRequests":
+		return dbus.MakeVariant(uint32(p.agent.active.Load())), nil
+	case "SessionId":
+		return dbus.MakeVariant(p.agent.session), nil
+	case "LastError":
+		msg := ""
+		if last := p.agent.lastError.Load(); last != nil {
+			msg = *last
+		}
+		return dbus.MakeVariant(msg), nil
+	}
+
+	return dbus.Variant{}, dbus.NewError("org.freedesktop.DBus.Error.UnknownProperty", []interface{}{name})
+}
+
+func (p agentProperties) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	if iface != statusInterface {
+		return map[string]dbus.Variant{}, nil
+	}
+
+	props := make(map[string]dbus.Variant, len(statusProperties))
+	for _, name := range statusProperties {
+		v, err := p.Get(iface, name)
+		if err != nil {
+			return nil, err
+		}
+		props[name] = v
+	}
+
+	return props, nil
+}
+
+func (p agentProperties) Set(iface, name string, _ dbus.Variant) *dbus.Error {
+	return dbus.NewError("org.freedesktop.DBus.Error.PropertyReadOnly", []interface{}{name})
+}
+
+// exportStatus exports the status interface on the agent's object.
+func exportStatus(conn *dbus.Conn, agent *Agent) error {
+	if err := conn.Export(agentStatus{}, dbus.ObjectPath(agentPath), statusInterface); err != nil {
+		return err
+	}
+
+	return conn.Export(agentProperties{agent: agent}, dbus.ObjectPath(agentPath), "org.freedesktop.DBus.Properties")
+}
+
+// printStatus reports whether an agent owns the bus name and for how long it
+// has been running. It returns the exit code.
+func printStatus() int {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		fmt.Printf("Failed to connect to system bus: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+
+	pid, err := nameOwnerPid(conn, agentBusName)
+	if err != nil {
+		// an agent not running as root has no bus name, only its lock
+		if pid, err := lockOwner(stateDir()); err == nil && os.Geteuid() != 0 {
+			if uptime, err := processUptime(pid); err == nil {
+				fmt.Println("wpka is running without root")
+				fmt.Printf("  PID:      %d\n", pid)
+				fmt.Printf("  Uptime:   %s\n", uptime)
+				return 0
+			}
+		}
+
+		fmt.Println("wpka is not running")
+		return 1
+	}
+
+	fmt.Println("wpka is running")
+	fmt.Printf("  Bus name: %s\n", agentBusName)
+	fmt.Printf("  PID:      %d\n", pid)
+
+	if uptime, err := processUptime(int(pid)); err == nil {
+		fmt.Printf("  Uptime:   %s\n", uptime)
+	}
+
+	obj := conn.Object(agentBusName, dbus.ObjectPath(agentPath))
+
+	if v, err := obj.GetProperty(statusInterface + ".SessionId"); err == nil {
+		fmt.Printf("  Session:  %v\n", v.Value())
+	}
+
+	if v, err := obj.GetProperty(statusInterface + ".ActiveRequests"); err == nil {
+		fmt.Printf("  Active:   %v\n", v.Value())
+	}
+
+	if v, err := obj.GetProperty(statusInterface + ".LastError"); err == nil && v.Value() != "" {
+		fmt.Printf("  Error:    %v\n", v.Value())
+	}
+
+	return 0
+}
+
+// clockTicks is USER_HZ, the unit of the times in /proc/<pid>/stat. It is
+// 100 on every architecture Linux supports.
+const clockTicks = 100
+
+// processUptime returns for how long pid has been running, from its start
+// time and the system's uptime in /proc.
+func processUptime(pid int) (time.Duration, error) {
+	start, err := processStartTime(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	b, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, errors.New("malformed /proc/uptime")
+	}
+
+	boot, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+
+	uptime := time.Duration(boot*float64(time.Second)) - time.Duration(start)*time.Second/clockTicks
+
+	return uptime.Round(time.Second), nil
+}
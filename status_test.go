@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProcessUptime(t *testing.T) {
+	uptime, err := processUptime(os.Getpid())
+	if err != nil {
+		t.Skipf("no /proc: %v", err)
+	}
+
+	if uptime < 0 || uptime > time.Hour {
+		t.Errorf("processUptime() = %s for the test binary", uptime)
+	}
+}
+
+func TestAgentProperties(t *testing.T) {
+	agent := &Agent{session: "c2"}
+	agent.active.Add(1)
+
+	p := agentProperties{agent: agent}
+
+	props, dbusErr := p.GetAll(statusInterface)
+	if dbusErr != nil {
+		t.Fatal(dbusErr)
+	}
+	if props["ActiveRequests"].Value() != uint32(1) || props["SessionId"].Value() != "c2" || props["LastError"].Value() != "" {
+		t.Errorf("GetAll() = %v", props)
+	}
+
+	msg := "invalid password"
+	agent.lastError.Store(&msg)
+
+	if v, _ := p.Get(statusInterface, "LastError"); v.Value() != msg {
+		t.Errorf("LastError = %v, want %q", v.Value(), msg)
+	}
+	if _, dbusErr := p.Get(statusInterface, "Unknown"); dbusErr == nil {
+		t.Errorf("unknown property didn't fail")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is set when packaging, f.e. with
+// -ldflags "-X main.version=1.2.3". Otherwise the module version from the
+// build info is used.
+var version = ""
+
+// printVersion prints the version, the commit wpka was built from and the Go
+// version. It returns the exit code.
+func printVersion() int {
+	v, commit, dirty := version, "unknown", false
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				commit = s.Value
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+	}
+
+	if v == "" {
+		v = "(devel)"
+	}
+	if dirty {
+		commit += "-dirty"
+	}
+
+	fmt.Printf("wpka %s\ncommit: %s\ngo: %s\n", v, commit, runtime.Version())
+
+	return 0
+}
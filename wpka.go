@@ -1,15 +1,29 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"maps"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/msteinert/pam"
@@ -21,8 +35,53 @@ const (
 	agentBusName   = "dev.benz.wpka.PolicyKit1.AuthenticationAgent"
 )
 
+var (
+	errPasswordExpired = errors.New("your password has expired, change it before authenticating")
+	errPromptBroken    = errors.New("the prompt command failed, check its configuration")
+	errPromptCancelled = errors.New("prompt cancelled")
+	errAuthTimeout     = errors.New("authentication timed out")
+	errInternal        = errors.New("internal error")
+)
+
+// errCancelled is the error polkit expects when the user dismissed the
+// request.
+const errCancelled = "org.freedesktop.PolicyKit1.Error.Cancelled"
+
 type Agent struct {
-	conn *dbus.Conn
+	// conn is replaced when reconnecting, use bus
+	conn    *dbus.Conn
+	session string
+	actions actionCache
+	dedup   dedupRequests
+	batch   batchRequests
+
+	// mu guards conn, draining, adding to inflight, failures, lockouts,
+	// authenticated and prompts
+	mu       sync.Mutex
+	draining bool
+	inflight sync.WaitGroup
+
+	// active counts the requests in flight for the ActiveRequests property
+	active atomic.Int32
+
+	// lastError is the error of the last failed request, for the LastError
+	// property
+	lastError atomic.Pointer[string]
+
+	// prompts holds the requests in progress by cookie, with the cancel
+	// func terminating their prompt
+	prompts map[string]context.CancelFunc
+
+	// failures counts the failed attempts of each uid since their last
+	// successful authentication or lockout
+	failures map[uint32]int
+
+	// lockouts holds when each locked out uid may authenticate again
+	lockouts map[uint32]time.Time
+
+	// authenticated holds the time of the last successful authentication
+	// of each uid, for cache_duration
+	authenticated map[uint32]time.Time
 }
 
 // Subject represents a PolicyKit subject
@@ -31,248 +90,1966 @@ type Subject struct {
 	Details map[string]dbus.Variant
 }
 
-func getPassword() (string, error) {
-	return execute(), nil
+// promptRequest holds the details of a request that can be shown by the
+// prompt.
+type promptRequest struct {
+	ActionID   string
+	ActionName string
+	Message    string
+	Icon       string
+	AuthKind   string
+
+	// command replaces the prompt command when set
+	command Command
+
+	// ctx is cancelled when polkit cancels the request or it times out,
+	// which terminates the prompt
+	ctx context.Context
+}
+
+// getPassword asks for the password. attempt counts from 1, on later
+// attempts the prompt is told that the previous password was wrong. The
+// caller wipes the returned password.
+func getPassword(req promptRequest, attempt int) ([]byte, error) {
+	env := []string{"WPKA_PROMPT=password", fmt.Sprintf("WPKA_ATTEMPT=%d", attempt)}
+	if attempt > 1 {
+		env = append(env, "WPKA_ERROR=Authentication failed, try again")
+	}
+
+	pw, err := runPrompt(req, env...)
+
+	return promptAnswer(req, pw, err)
+}
+
+// promptAnswer maps the result of a prompt to errPromptCancelled when the
+// request was cancelled or the user dismissed the prompt.
+func promptAnswer(req promptRequest, answer []byte, err error) ([]byte, error) {
+	if req.ctx != nil && req.ctx.Err() != nil {
+		wipe(answer)
+		return nil, errPromptCancelled
+	}
+
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) && !errors.Is(err, errPromptBroken) {
+		// fuzzel, wofi and friends exit 1 on Escape
+		return nil, fmt.Errorf("%w: %w", errPromptCancelled, err)
+	}
+	if err == nil && len(answer) == 0 {
+		return nil, errPromptCancelled
+	}
+
+	return answer, err
+}
+
+// getCode asks for a visible answer to a PAM prompt, f.e. a one-time code
+// of an authenticator app. msg is PAM's prompt text.
+func getCode(req promptRequest, msg string) (string, error) {
+	req.Message = sanitizePAMMessage(msg)
+
+	code, err := runPrompt(req, "WPKA_PROMPT=code", "WPKA_MASK=")
+	code, err = promptAnswer(req, code, err)
+
+	return string(code), err
+}
+
+// getSecret asks for another hidden answer to a PAM prompt after the
+// password, f.e. a PIN. msg is PAM's prompt text.
+func getSecret(req promptRequest, msg string) (string, error) {
+	req.Message = sanitizePAMMessage(msg)
+
+	secret, err := runPrompt(req, "WPKA_PROMPT=secret")
+	secret, err = promptAnswer(req, secret, err)
+	defer wipe(secret)
+
+	return string(secret), err
+}
+
+// getConfirmation asks the user to type phrase before a high-risk action is
+// authenticated.
+func getConfirmation(req promptRequest, phrase string) error {
+	typed, err := runPrompt(req, "WPKA_PROMPT=confirm", fmt.Sprintf("WPKA_CONFIRM_PHRASE=%s", phrase))
+	if err != nil {
+		return err
+	}
+	if string(typed) != phrase {
+		return fmt.Errorf("confirmation phrase did not match")
+	}
+
+	return nil
+}
+
+// BeginAuthentication handles the authentication request
+func (a *Agent) BeginAuthentication(actionId string, message string, iconName string, details map[string]string, cookie string, identities []interface{}) (dbusErr *dbus.Error) {
+	start := time.Now()
+	stats.requests.Add(1)
+
+	var (
+		uid         uint64
+		uidKnown    bool
+		currentUser string
+		attempts    int
+		timedOut    bool
+	)
+
+	defer func() {
+		duration := time.Since(start)
+		stats.observe(duration)
+
+		result := "success"
+		switch {
+		case timedOut:
+			result = "timeout"
+			stats.timeout.Add(1)
+		case dbusErr != nil && dbusErr.Name == errCancelled:
+			// counted by cancelled
+			result = "cancelled"
+		case dbusErr != nil:
+			result = "failure"
+			stats.failure.Add(1)
+		default:
+			stats.success.Add(1)
+		}
+
+		if result == "timeout" || result == "failure" {
+			msg := dbusErr.Error()
+			a.lastError.Store(&msg)
+		}
+
+		slog.Info("Authentication finished", "action_id", actionId, "uid", uid, "result", result, "duration", duration)
+
+		rec := auditRecord{
+			Time:     start,
+			ActionID: actionId,
+			User:     currentUser,
+			Result:   result,
+			Attempts: attempts,
+		}
+		if uidKnown {
+			u := uint32(uid)
+			rec.UID = &u
+		}
+		audit.write(rec)
+
+		runHook("on_auth_command", conf().OnAuthCommand,
+			fmt.Sprintf("WPKA_RESULT=%s", result),
+			fmt.Sprintf("WPKA_ACTION_ID=%s", actionId),
+			fmt.Sprintf("WPKA_USER=%s", currentUser),
+		)
+	}()
+
+	// refused requests are still counted and audited
+	if !a.track() {
+		warnf("Refusing authentication request, shutting down")
+		return dbus.MakeFailedError(fmt.Errorf("agent is shutting down"))
+	}
+	defer a.untrack()
+
+	// a bug while handling one request fails it instead of taking down
+	// the agent
+	defer func() {
+		if r := recover(); r != nil {
+			errorf("Authentication request panicked: %v", r)
+			dbusErr = dbus.MakeFailedError(errInternal)
+		}
+	}()
+
+	infof("Authentication requested for action: %s", actionId)
+	debugf("Message: %s", message)
+	slog.Debug("Authentication cookie", "cookie_hash", hashCookie(cookie))
+
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	if conf().AuthTimeoutSeconds > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(conf().AuthTimeoutSeconds)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	if err := a.addPrompt(cookie, cancel); err != nil {
+		cancel()
+		warnf("Denying request: %v", err)
+		return dbus.MakeFailedError(err)
+	}
+	defer a.removePrompt(cookie)
+
+	if actionId == "" && !conf().AllowEmptyActionID {
+		warnf("Denying request without action id")
+		return dbus.MakeFailedError(fmt.Errorf("missing action id"))
+	}
+
+	owner, err := a.sessionOwner()
+	if err != nil {
+		infof("Could not determine the session owner: %v", err)
+	}
+
+	ids, err := parseIdentities(identities)
+	if err != nil {
+		infof("Invalid identities for %s: %v", actionId, err)
+		return dbus.MakeFailedError(err)
+	}
+
+	userInfo, err := chooseIdentity(ids, owner)
+	if err != nil {
+		infof("No identity to authenticate for %s: %v", actionId, err)
+		return dbus.MakeFailedError(err)
+	}
+
+	currentUser = userInfo.Username
+	infof("Authenticating as user: %s", currentUser)
+
+	uid, err = strconv.ParseUint(userInfo.Uid, 10, 32)
+	if err != nil {
+		warnf("Failed to parse UID: %v", err)
+		return dbus.MakeFailedError(err)
+	}
+	uidKnown = true
+
+	if err := checkUID(uint32(uid), authKind(ids, userInfo.Uid)); err != nil {
+		warnf("Denying %s for user %s (uid: %d): %v", actionId, currentUser, uid, err)
+		return dbus.MakeFailedError(err)
+	}
+
+	if wait := a.lockedOut(uint32(uid)); wait > 0 {
+		wait = wait.Round(time.Second)
+		warnf("Denying %s for user %s (uid: %d), locked out for %s", actionId, currentUser, uid, wait)
+		return dbus.MakeFailedError(fmt.Errorf("too many failed attempts, try again in %s", wait))
+	}
+
+	if isTrustedAction(actionId) {
+		// only the session's own user, for actions polkit would let them
+		// do with their own password, never as someone else
+		switch {
+		case uid == 0:
+			infof("Not auto-approving trusted action %s for root", actionId)
+		case owner == nil || owner.Uid != userInfo.Uid:
+			infof("Not auto-approving trusted action %s for %s, not the session's user", actionId, currentUser)
+		case authKind(ids, userInfo.Uid) != "self" || !a.actionSelfOnly(actionId):
+			warnf("Not auto-approving trusted action %s, it needs an administrator", actionId)
+		default:
+			warnf("Auto-approving trusted action %s for user %s without a prompt", actionId, currentUser)
+			return a.sendResponse(uint32(uid), cookie)
+		}
+	}
+
+	if a.recentlyAuthenticated(uint32(uid), actionId) {
+		infof("Approving %s for user %s, authenticated within the last %ds", actionId, currentUser, conf().CacheDuration)
+		return a.sendResponse(uint32(uid), cookie)
+	}
+
+	// the request took too long, a running prompt has been killed
+	timeout := func() *dbus.Error {
+		timedOut = true
+		infof("Authentication for %s timed out after %ds", actionId, conf().AuthTimeoutSeconds)
+		return dbus.MakeFailedError(errAuthTimeout)
+	}
+
+	if conf().DedupWindowMs > 0 {
+		entry, leader := a.dedup.join(dedupKey(actionId, currentUser, message, details))
+		if !leader {
+			return a.follow(ctx, entry, uint32(uid), cookie, timeout)
+		}
+
+		defer entry.finishDeferred(&dbusErr)
+	}
+
+	req := promptRequest{
+		ActionID:   actionId,
+		ActionName: a.actionName(actionId),
+		Message:    a.resolveMessage(actionId, message),
+		Icon:       iconName,
+		AuthKind:   authKind(ids, userInfo.Uid),
+	}
+
+	if o, ok := actionOverride(actionId); ok {
+		if o.Message != "" {
+			req.Message = o.Message
+		}
+		if o.Icon != "" {
+			req.Icon = o.Icon
+		}
+		req.command = o.PromptCommand
+	}
+
+	req.ctx = ctx
+
+	if phrase, ok := conf().ConfirmActions[actionId]; ok {
+		if phrase == "" {
+			phrase = actionId
+		}
+
+		if err := getConfirmation(req, phrase); err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return timeout()
+			}
+			if ctx.Err() != nil {
+				return a.cancelled(cookie)
+			}
+
+			infof("Confirmation for action %s failed: %v", actionId, err)
+			return dbus.MakeFailedError(err)
+		}
+	}
+
+	// requests with their own confirmation or prompt command always get
+	// their own prompt
+	_, confirm := conf().ConfirmActions[actionId]
+	if conf().BatchWindowMs > 0 && !confirm && req.command.Empty() {
+		key := batchKey(uint32(uid), req.AuthKind, a.session)
+
+		entry, leader := a.batch.join(key, req.ActionName)
+		if !leader {
+			infof("Adding %s to the pending prompt of user %s", actionId, currentUser)
+			return a.follow(ctx, &entry.dedupEntry, uint32(uid), cookie, timeout)
+		}
+
+		defer entry.finishDeferred(&dbusErr)
+
+		select {
+		case <-time.After(time.Duration(conf().BatchWindowMs) * time.Millisecond):
+		case <-ctx.Done():
+		}
+
+		if actions := a.batch.close(key, entry); len(actions) > 1 {
+			infof("One prompt for %d requests of user %s: %s", len(actions), currentUser, strings.Join(actions, ", "))
+			req.Message = fmt.Sprintf("Authentication is required for %d actions: %s", len(actions), strings.Join(actions, ", "))
+		}
+	}
+
+	service := conf().PAMService
+	if conf().PAMServiceRemote != "" && isRemoteSession(a.session) {
+		service = conf().PAMServiceRemote
+		infof("Remote session, using PAM service: %s", service)
+	}
+
+	for attempt := 1; ; attempt++ {
+		attempts = attempt
+
+		// PAM runs first and asks for the password only when a module
+		// wants one, with pam_fprintd a fingerprint may do without
+		var promptErr error
+
+		handlers := pamHandlers{
+			password: func() ([]byte, error) {
+				pw, err := getPassword(req, attempt)
+				promptErr = err
+				return pw, err
+			},
+			prompt: func(msg string) (string, error) {
+				code, err := getCode(req, msg)
+				promptErr = err
+				return code, err
+			},
+			secret: func(msg string) (string, error) {
+				secret, err := getSecret(req, msg)
+				promptErr = err
+				return secret, err
+			},
+		}
+
+		if conf().ShowPAMMessages {
+			handlers.message = func(msg string, password []byte) {
+				showPAMMessage(req, msg, password)
+			}
+		}
+
+		if os.Geteuid() == 0 {
+			err = PAMAuth(service, currentUser, handlers)
+		} else {
+			err = helperAuth(ctx, currentUser, cookie, handlers)
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return timeout()
+		}
+		if errors.Is(promptErr, errPromptBroken) {
+			return dbus.MakeFailedError(errPromptBroken)
+		}
+		if errors.Is(promptErr, errPromptCancelled) {
+			// cancelling doesn't count as a failed attempt
+			return a.cancelled(cookie)
+		}
+		if promptErr != nil {
+			warnf("Failed to get password: %v", promptErr)
+			return dbus.MakeFailedError(promptErr)
+		}
+		if err == nil {
+			break
+		}
+		if errors.Is(err, errHelperUnavailable) {
+			errorf("Failed to run polkit-agent-helper-1: %v", err)
+			return dbus.MakeFailedError(err)
+		}
+
+		// the password was right, it doesn't count as a failure
+		if errors.Is(err, errPasswordExpired) {
+			infof("Password of user %s has expired", currentUser)
+			return dbus.MakeFailedError(err)
+		}
+
+		if a.failed(actionId, currentUser, uint32(uid)) {
+			warnf("Locking out user %s (uid: %d) for %ds after %d failed attempts", currentUser, uid, conf().LockoutDuration, conf().MaxFailures)
+			return dbus.MakeFailedError(fmt.Errorf("too many failed attempts, try again in %ds", conf().LockoutDuration))
+		}
+
+		warnf("Failed to authenticate with PAM (attempt %d): %v", attempt, err)
+
+		if attempt > conf().MaxRetries {
+			if conf().NotifyOnFailure {
+				notifyFailure(req.ActionName)
+			}
+
+			return dbus.MakeFailedError(fmt.Errorf("invalid password"))
+		}
+	}
+
+	infof("Authenticated user %s (uid: %d)", currentUser, uid)
+
+	a.mu.Lock()
+	delete(a.failures, uint32(uid))
+	if conf().CacheDuration > 0 {
+		if a.authenticated == nil {
+			a.authenticated = make(map[uint32]time.Time)
+		}
+		a.authenticated[uint32(uid)] = time.Now()
+	}
+	a.mu.Unlock()
+
+	// the helper has answered polkit already
+	if os.Geteuid() != 0 {
+		return nil
+	}
+
+	return a.sendResponse(uint32(uid), cookie)
+}
+
+// follow waits for the authentication entry is shared with and answers the
+// request for cookie with its result. timeout reports the request timing
+// out while waiting.
+func (a *Agent) follow(ctx context.Context, entry *dedupEntry, uid uint32, cookie string, timeout func() *dbus.Error) *dbus.Error {
+	result, err := entry.wait(ctx)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return timeout()
+	case err != nil:
+		return a.cancelled(cookie)
+	case result != nil:
+		return result
+	}
+
+	return a.sendResponse(uid, cookie)
+}
+
+// recentlyAuthenticated reports whether uid authenticated successfully
+// within cache_duration, so actionId can be approved without a prompt. Only
+// actions that polkit lets retain their authorization (the _keep implicit
+// authorizations) are approved this way, and never ones in confirm_actions.
+func (a *Agent) recentlyAuthenticated(uid uint32, actionId string) bool {
+	if conf().CacheDuration <= 0 {
+		return false
+	}
+
+	if _, ok := conf().ConfirmActions[actionId]; ok {
+		return false
+	}
+
+	a.mu.Lock()
+	last, ok := a.authenticated[uid]
+	if ok && time.Since(last) > time.Duration(conf().CacheDuration)*time.Second {
+		delete(a.authenticated, uid)
+		ok = false
+	}
+	a.mu.Unlock()
+
+	return ok && a.actionRetained(actionId)
+}
+
+// sessionOwner returns the user owning the agent's session. Without logind
+// it falls back to the user that invoked sudo, or USER.
+func (a *Agent) sessionOwner() (*user.User, error) {
+	if uid, err := sessionUID(a.session); err == nil {
+		if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+			return u, nil
+		}
+	}
+
+	name := os.Getenv("SUDO_USER")
+	if name == "" {
+		name = os.Getenv("USER")
+	}
+	if name == "" {
+		return nil, fmt.Errorf("could not determine user")
+	}
+
+	return lookupUser(name)
+}
+
+// checkUID guards against authenticating an unexpected account, f.e. when
+// SUDO_USER isn't set as expected.
+func checkUID(uid uint32, kind string) error {
+	if uid < conf().MinUID {
+		return fmt.Errorf("uid %d is below min_uid %d", uid, conf().MinUID)
+	}
+
+	if uid == 0 && kind == "self" && !conf().AllowRootSelf {
+		return fmt.Errorf("authenticating root for its own actions is not allowed")
+	}
+
+	return nil
+}
+
+// hashCookie returns a short hash of cookie for logging. The cookie itself
+// authorizes the response to polkit and is never logged.
+func hashCookie(cookie string) string {
+	sum := sha256.Sum256([]byte(cookie))
+	return hex.EncodeToString(sum[:8])
+}
+
+// failed counts a failed authentication of userName and runs
+// on_failure_command. The password is never passed to the hook. It reports
+// whether uid is locked out now, after max_failures consecutive failures.
+func (a *Agent) failed(actionId, userName string, uid uint32) (locked bool) {
+	a.mu.Lock()
+	if a.failures == nil {
+		a.failures = make(map[uint32]int)
+	}
+	a.failures[uid]++
+	attempt := a.failures[uid]
+
+	if conf().MaxFailures > 0 && conf().LockoutDuration > 0 && attempt >= conf().MaxFailures {
+		if a.lockouts == nil {
+			a.lockouts = make(map[uint32]time.Time)
+		}
+		a.lockouts[uid] = time.Now().Add(time.Duration(conf().LockoutDuration) * time.Second)
+		locked = true
+	}
+	a.mu.Unlock()
+
+	runHookAs("on_failure_command", conf().OnFailureCommand, conf().OnFailureRunAs == "user",
+		fmt.Sprintf("WPKA_ACTION_ID=%s", actionId),
+		fmt.Sprintf("WPKA_ATTEMPT=%d", attempt),
+		fmt.Sprintf("WPKA_USER=%s", userName),
+	)
+
+	return locked
+}
+
+// lockedOut returns how long uid stays locked out, 0 when it isn't. An
+// expired lockout starts counting failures anew.
+func (a *Agent) lockedOut(uid uint32) time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	until, ok := a.lockouts[uid]
+	if !ok {
+		return 0
+	}
+
+	wait := time.Until(until)
+	if wait <= 0 {
+		delete(a.lockouts, uid)
+		delete(a.failures, uid)
+		return 0
+	}
+
+	return wait
+}
+
+// bus returns the current system bus connection.
+func (a *Agent) bus() *dbus.Conn {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.conn
+}
+
+// setConn replaces the system bus connection after reconnecting.
+func (a *Agent) setConn(conn *dbus.Conn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.conn = conn
+}
+
+// track registers a new request as in flight. It fails once the agent is
+// draining for shutdown.
+func (a *Agent) track() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.draining {
+		return false
+	}
+
+	a.inflight.Add(1)
+	a.active.Add(1)
+
+	return true
+}
+
+// untrack marks a request tracked by track as finished.
+func (a *Agent) untrack() {
+	a.active.Add(-1)
+	a.inflight.Done()
+}
+
+// drain stops accepting requests and waits up to timeout for the ones in
+// flight. It reports whether all of them finished.
+func (a *Agent) drain(timeout time.Duration) bool {
+	a.mu.Lock()
+	a.draining = true
+	a.mu.Unlock()
+
+	// no new request is tracked from here on, so an idle agent is done
+	// even with a timeout of 0
+	if a.active.Load() == 0 {
+		return true
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		a.inflight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// legacyResponse is set once polkit turned out to lack
+// AuthenticationAgentResponse2.
+var legacyResponse atomic.Bool
+
+// sendResponse tells polkit that uid has been authenticated for cookie.
+func (a *Agent) sendResponse(uid uint32, cookie string) *dbus.Error {
+	// Create the identity structure in the format PolicyKit expects: (sa{sv})
+	identity := struct {
+		Kind    string
+		Details map[string]dbus.Variant
+	}{
+		Kind: "unix-user",
+		Details: map[string]dbus.Variant{
+			"uid": dbus.MakeVariant(uid),
+		},
+	}
+
+	// Send authentication response
+	obj := a.bus().Object("org.freedesktop.PolicyKit1", "/org/freedesktop/PolicyKit1/Authority")
+
+	var call *dbus.Call
+	if !legacyResponse.Load() {
+		call = obj.Call("org.freedesktop.PolicyKit1.Authority.AuthenticationAgentResponse2", 0,
+			uid,      // u
+			cookie,   // s
+			identity, // (sa{sv})
+		)
+	}
+
+	var dbusErr dbus.Error
+	if call == nil || (errors.As(call.Err, &dbusErr) && dbusErr.Name == "org.freedesktop.DBus.Error.UnknownMethod") {
+		if legacyResponse.CompareAndSwap(false, true) {
+			infof("polkit has no AuthenticationAgentResponse2, using AuthenticationAgentResponse")
+		}
+
+		// polkit before 0.114 only has this one, it takes the uid from
+		// the caller, which is root
+		call = obj.Call("org.freedesktop.PolicyKit1.Authority.AuthenticationAgentResponse", 0,
+			cookie,   // s
+			identity, // (sa{sv})
+		)
+	}
+
+	if call.Err != nil {
+		errorf("Failed to send authentication response: %v", call.Err)
+		return dbus.MakeFailedError(call.Err)
+	}
+
+	infof("Authentication response sent successfully")
+	return nil
+}
+
+func (a *Agent) CancelAuthentication(cookie string) *dbus.Error {
+	a.mu.Lock()
+	cancel, ok := a.prompts[cookie]
+	a.mu.Unlock()
+
+	if !ok {
+		warnf("Ignoring cancellation of an unknown request")
+		slog.Debug("Unknown cookie", "cookie_hash", hashCookie(cookie))
+		return dbus.MakeFailedError(fmt.Errorf("no authentication in progress for this cookie"))
+	}
+
+	// BeginAuthentication reports the request as cancelled once its
+	// prompt is gone
+	infof("Cancelling prompt")
+	cancel()
+	return nil
+}
+
+// addPrompt registers the cancel func of the request for cookie. polkit
+// hands out a unique cookie per request, an empty one or one already in
+// use is refused.
+func (a *Agent) addPrompt(cookie string, cancel context.CancelFunc) error {
+	if cookie == "" {
+		return fmt.Errorf("missing cookie")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.prompts[cookie]; ok {
+		return fmt.Errorf("cookie already in use by another request")
+	}
+
+	if a.prompts == nil {
+		a.prompts = make(map[string]context.CancelFunc)
+	}
+	a.prompts[cookie] = cancel
+
+	return nil
+}
+
+// cancelPrompts terminates the prompts of all pending requests.
+func (a *Agent) cancelPrompts() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, cancel := range a.prompts {
+		cancel()
+	}
+}
+
+// removePrompt releases the cancel func of the request for cookie.
+func (a *Agent) removePrompt(cookie string) {
+	a.mu.Lock()
+	cancel := a.prompts[cookie]
+	delete(a.prompts, cookie)
+	a.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// cancelled logs a request cancelled by polkit or the user and returns the
+// error telling polkit about it.
+func (a *Agent) cancelled(cookie string) *dbus.Error {
+	infof("Authentication cancelled")
+	slog.Debug("Authentication cancelled", "cookie_hash", hashCookie(cookie))
+	stats.cancel.Add(1)
+
+	return dbus.NewError(errCancelled, []interface{}{"Authentication was cancelled"})
+}
+
+// getCurrentSession detects the session id using the configured
+// session_backend. "auto" tries the environment first and logind after.
+func getCurrentSession() (string, error) {
+	switch conf().SessionBackend {
+	case "env":
+		return getEnvSession()
+	case "logind", "elogind":
+		return getLogindSession(conf().SessionBackend)
+	}
+
+	if session, err := getEnvSession(); err == nil {
+		return session, nil
+	}
+
+	return getLogindSession("logind")
+}
+
+func getEnvSession() (string, error) {
+	if session := os.Getenv("XDG_SESSION_ID"); session != "" {
+		return session, nil
+	}
+
+	return "", fmt.Errorf("XDG_SESSION_ID not set")
+}
+
+// isTrustedAction reports whether actionId is listed in trusted_actions.
+func isTrustedAction(actionId string) bool {
+	for _, v := range conf().TrustedActions {
+		if v == actionId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isRemoteSession reports whether the session is a remote one, f.e. ssh.
+func isRemoteSession(session string) bool {
+	if v, err := sessionProperty(session, "Remote"); err == nil {
+		if remote, ok := v.Value().(bool); ok {
+			return remote
+		}
+	}
+
+	return os.Getenv("SSH_CONNECTION") != ""
+}
+
+// launchMechanism guesses how wpka was started from the environment the
+// launcher leaves behind.
+func launchMechanism() string {
+	switch {
+	case os.Getenv("INVOCATION_ID") != "":
+		return "systemd"
+	case os.Getenv("DESKTOP_AUTOSTART_ID") != "":
+		return "XDG autostart"
+	case os.Getenv("SUDO_USER") != "":
+		return "sudo"
+	}
+
+	return "unknown launcher"
+}
+
+// nameOwnerPid returns the pid of the process owning name on the bus.
+func nameOwnerPid(conn *dbus.Conn, name string) (uint32, error) {
+	var owner string
+
+	err := conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, name).Store(&owner)
+	if err != nil {
+		return 0, err
+	}
+
+	var pid uint32
+
+	err = conn.BusObject().Call("org.freedesktop.DBus.GetConnectionUnixProcessID", 0, owner).Store(&pid)
+
+	return pid, err
+}
+
+// lockMemory locks all current and future memory pages, so passwords are
+// never swapped to disk. This needs CAP_IPC_LOCK (root has it) or a large
+// enough RLIMIT_MEMLOCK, failing is only a warning.
+func lockMemory() {
+	if err := syscall.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE); err != nil {
+		warnf("Failed to lock memory: %v", err)
+		return
+	}
+
+	infof("Memory locked")
+}
+
+// agentSubject returns the subject the agent registers for, as configured
+// by subject_kind.
+func agentSubject(sessionId string) (Subject, error) {
+	if conf().SubjectKind == "unix-process" {
+		return processSubject()
+	}
+
+	return sessionSubject(sessionId), nil
+}
+
+// processSubject creates a unix-process subject for wpka itself. polkit
+// identifies processes by pid and start time, the latter guards against
+// reused pids.
+func processSubject() (Subject, error) {
+	startTime, err := processStartTime(os.Getpid())
+	if err != nil {
+		return Subject{}, err
+	}
+
+	return Subject{
+		Kind: "unix-process",
+		Details: map[string]dbus.Variant{
+			"pid":        dbus.MakeVariant(uint32(os.Getpid())),
+			"start-time": dbus.MakeVariant(startTime),
+		},
+	}, nil
+}
+
+// processStartTime reads the start time of pid, in clock ticks since boot,
+// from the 22nd field of /proc/<pid>/stat.
+func processStartTime(pid int) (uint64, error) {
+	b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+
+	// the command name in field 2 may contain spaces and parentheses,
+	// the fields after it start behind the last ')'
+	i := bytes.LastIndexByte(b, ')')
+	if i < 0 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+
+	fields := strings.Fields(string(b[i+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// sessionSubject creates the unix-session subject structure exactly as
+// PolicyKit expects.
+func sessionSubject(sessionId string) Subject {
+	return Subject{
+		Kind: "unix-session",
+		Details: map[string]dbus.Variant{
+			"session-id": dbus.MakeVariant(sessionId),
+		},
+	}
+}
+
+// registerAgent registers the exported agent with polkit for subject.
+func registerAgent(conn *dbus.Conn, subject Subject) error {
+	// polkit translates messages into the one locale given at registration.
+	// A second registration for the same subject is refused, so fallback
+	// locales can't be registered; the prompt gets the same locale as
+	// LC_MESSAGES instead.
+	obj := conn.Object("org.freedesktop.PolicyKit1", "/org/freedesktop/PolicyKit1/Authority")
+	call := obj.Call("org.freedesktop.PolicyKit1.Authority.RegisterAuthenticationAgent", 0,
+		subject,
+		conf().Locale,
+		agentPath,
+	)
+
+	if call.Err != nil {
+		return call.Err
+	}
+
+	// Also register with options
+	call = obj.Call("org.freedesktop.PolicyKit1.Authority.RegisterAuthenticationAgentWithOptions", 0,
+		subject,
+		conf().Locale,
+		agentPath,
+		map[string]dbus.Variant{},
+	)
+
+	if call.Err != nil {
+		warnf("Failed to register with options: %v", call.Err)
+	}
+
+	return nil
+}
+
+// unregisterAgent removes the agent's registration for subject.
+func unregisterAgent(conn *dbus.Conn, subject Subject) error {
+	obj := conn.Object("org.freedesktop.PolicyKit1", "/org/freedesktop/PolicyKit1/Authority")
+	call := obj.Call("org.freedesktop.PolicyKit1.Authority.UnregisterAuthenticationAgent", 0,
+		subject,
+		agentPath,
+	)
+
+	return call.Err
+}
+
+// takeFlag returns the value of the option name, given as "name value" or
+// "name=value" before the prompt command, and removes it from os.Args so it
+// doesn't end up in the prompt command.
+func takeFlag(name string) (string, bool) {
+	for i := 1; i < len(os.Args) && strings.HasPrefix(os.Args[i], "--"); i++ {
+		if v, ok := strings.CutPrefix(os.Args[i], name+"="); ok {
+			os.Args = append(os.Args[:i], os.Args[i+1:]...)
+			return v, true
+		}
+
+		if os.Args[i] == name && i+1 < len(os.Args) {
+			v := os.Args[i+1]
+			os.Args = append(os.Args[:i], os.Args[i+2:]...)
+			return v, true
+		}
+
+		if !strings.Contains(os.Args[i], "=") {
+			// skip the value of another option
+			i++
+		}
+	}
+
+	return "", false
+}
+
+// subcommand removes the mode wpka runs in from os.Args and returns it:
+// "agent", "prompt", "test", "status", "probe" or "version". Without one
+// wpka runs the agent with the remaining arguments as prompt command, as it
+// did before subcommands existed, and legacy is set.
+func subcommand() (mode string, legacy bool) {
+	if len(os.Args) < 2 {
+		return "agent", true
+	}
+
+	switch os.Args[1] {
+	case "agent", "prompt", "test", "status", "probe", "version":
+		mode = os.Args[1]
+	case "--version":
+		mode = "version"
+	case "--status", "--probe":
+		mode, legacy = strings.TrimPrefix(os.Args[1], "--"), true
+	default:
+		return "agent", true
+	}
+
+	os.Args = append(os.Args[:1], os.Args[2:]...)
+
+	return mode, legacy
+}
+
+// promptOnce runs the prompt command once, the way the agent would for a
+// request, and prints the answer. It returns the prompt's exit code.
+func promptOnce() int {
+	pw, err := runPrompt(promptRequest{Message: conf().DefaultMessage}, "WPKA_PROMPT=password", "WPKA_ATTEMPT=1")
+	defer wipe(pw)
+
+	if err != nil {
+		var exitError *exec.ExitError
+		if errors.As(err, &exitError) {
+			return exitError.ExitCode()
+		}
+
+		errorf("Prompt failed: %v", err)
+		return 1
+	}
+
+	os.Stdout.Write(pw)
+	fmt.Println()
+
+	return 0
+}
+
+func main() {
+	mode, legacy := subcommand()
+	switch mode {
+	case "status":
+		os.Exit(printStatus())
+	case "version":
+		os.Exit(printVersion())
+	}
+
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	config.Store(&c)
+
+	setupLogger(conf().LogFormat)
+
+	level, err := logLevelFromArgs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	setLogLevel(level)
+
+	if legacy {
+		warnf("Running without a subcommand is deprecated, use \"wpka %s\"", mode)
+	}
+
+	if service, ok := takeFlag("--pam-service"); ok && (mode == "agent" || mode == "test") {
+		pamServiceFlag = service
+	}
+
+	c = *conf()
+	if err := applyPAMServiceFlag(&c); err != nil {
+		log.Fatalf("Invalid arguments: %v", err)
+	}
+	if err := selectPromptCommand(&c); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	if os.Geteuid() != 0 && mode == "agent" {
+		infof("Not running as root, passwords are checked with polkit-agent-helper-1")
+		applyUnprivileged(&c)
+	}
+	config.Store(&c)
+
+	if conf().Locale == "" {
+		updateConfig(func(c *Config) { c.Locale = sessionLocale() })
+	}
+	infof("Using locale %s", conf().Locale)
+
+	infof("Started by %s", launchMechanism())
+
+	if conf().LockMemory {
+		lockMemory()
+	}
+
+	switch mode {
+	case "probe":
+		os.Exit(probe(os.Args[1:]))
+	case "prompt":
+		os.Exit(promptOnce())
+	case "test":
+		os.Exit(selfTest())
+	}
+
+	lock, err := acquireLock(stateDir(), conf().CleanStaleState)
+	if errors.Is(err, errLocked) {
+		if pid, err := lockOwner(stateDir()); err == nil {
+			infof("wpka is already running (pid %d), exiting", pid)
+		} else {
+			infof("wpka is already running, exiting")
+		}
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Failed to lock %s: %v", stateDir(), err)
+	}
+
+	if conf().MetricsListen != "" {
+		if err := serveMetrics(conf().MetricsListen); err != nil {
+			log.Fatalf("Failed to serve metrics: %v", err)
+		}
+	}
+
+	sessionId, err := getCurrentSession()
+	if err != nil && conf().SubjectKind == "unix-session" {
+		log.Fatalf("Failed to get current session: %v", err)
+	}
+	if err != nil {
+		warnf("Failed to get current session: %v", err)
+	} else {
+		infof("Using session ID: %s", sessionId)
+	}
+
+	agent := &Agent{session: sessionId}
+
+	subject, err := agentSubject(sessionId)
+	if err != nil {
+		log.Fatalf("Failed to create subject: %v", err)
+	}
+
+	conn, err := connect(agent, subject)
+	if errors.Is(err, errAlreadyRunning) {
+		// Another instance started by a different autostart mechanism
+		// already runs. Exit cleanly so it isn't treated as a failure.
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("Failed to start agent: %v", err)
+	}
+
+	infof("Successfully registered authentication agent")
+	runHook("on_register_command", conf().OnRegisterCommand, fmt.Sprintf("WPKA_SESSION_ID=%s", sessionId))
+	fmt.Println("PolicyKit agent started. Waiting for authentication requests...")
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+
+	polkit := watchPolkit(conn)
+
+	for {
+		select {
+		case <-reloads:
+			infof("Received SIGHUP, reloading config")
+			reloadConfig()
+		case sig := <-signals:
+			infof("Received %s, shutting down", sig)
+			shutdown(conn, agent, subject)
+			lock.release()
+			return
+		case s, ok := <-polkit:
+			if !ok {
+				// closed with the connection, which is handled below
+				polkit = nil
+				continue
+			}
+
+			polkitOwnerChanged(conn, agent, subject, s)
+		case <-conn.Context().Done():
+			infof("Lost connection to the system bus, reconnecting")
+
+			if conn = reconnect(agent, subject, signals); conn == nil {
+				lock.release()
+				return
+			}
+
+			polkit = watchPolkit(conn)
+		}
+	}
+}
+
+// errAlreadyRunning is returned by connect when another instance owns the
+// bus name.
+var errAlreadyRunning = errors.New("wpka is already running")
+
+// connect connects to the system bus, takes the bus name, exports agent and
+// registers it with polkit.
+func connect(agent *Agent, subject Subject) (*dbus.Conn, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to system bus: %w", err)
+	}
+
+	// only root may own the bus name, without root the lock file keeps
+	// it to one instance per user and polkit calls the unique name
+	if os.Geteuid() == 0 {
+		reply, err := conn.RequestName(agentBusName,
+			dbus.NameFlagDoNotQueue)
+		if err != nil {
+			return nil, fmt.Errorf("failed to request name: %w", err)
+		}
+
+		// a failed attempt to reconnect may have taken the name already
+		if reply != dbus.RequestNameReplyPrimaryOwner && reply != dbus.RequestNameReplyAlreadyOwner {
+			if pid, err := nameOwnerPid(conn, agentBusName); err == nil {
+				infof("wpka is already running (pid %d), exiting", pid)
+			} else {
+				infof("wpka is already running, exiting")
+			}
+			return nil, errAlreadyRunning
+		}
+	}
+
+	agent.setConn(conn)
+
+	err = conn.Export(agent, dbus.ObjectPath(agentPath), agentInterface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export agent: %w", err)
+	}
+
+	if err := exportStatus(conn, agent); err != nil {
+		return nil, fmt.Errorf("failed to export status interface: %w", err)
+	}
+
+	if conf().ManagementInterface {
+		err = conn.Export(&Management{conn: conn}, dbus.ObjectPath(agentPath), managementInterface)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export management interface: %w", err)
+		}
+	}
+
+	if err := registerAgent(conn, subject); err != nil {
+		return nil, fmt.Errorf("failed to register authentication agent: %w", err)
+	}
+
+	return conn, nil
+}
+
+// reconnect retries connect with a growing delay until it succeeds. It
+// returns nil when a signal arrives meanwhile or another instance took over.
+func reconnect(agent *Agent, subject Subject, signals <-chan os.Signal) *dbus.Conn {
+	delay := time.Second
+
+	for {
+		select {
+		case sig := <-signals:
+			infof("Received %s, shutting down", sig)
+			return nil
+		case <-time.After(delay):
+		}
+
+		conn, err := connect(agent, subject)
+		if err == nil {
+			infof("Reconnected and registered authentication agent")
+			return conn
+		}
+		if errors.Is(err, errAlreadyRunning) {
+			return nil
+		}
+
+		warnf("Failed to reconnect: %v", err)
+		delay = min(delay*2, 30*time.Second)
+	}
+}
+
+// watchPolkit subscribes to polkit's bus name changing its owner, which
+// happens when polkitd restarts. The new instance doesn't know the agent.
+// It returns nil when subscribing fails, restarts then go unnoticed.
+func watchPolkit(conn *dbus.Conn) <-chan *dbus.Signal {
+	err := conn.AddMatchSignal(
+		dbus.WithMatchSender("org.freedesktop.DBus"),
+		dbus.WithMatchInterface("org.freedesktop.DBus"),
+		dbus.WithMatchMember("NameOwnerChanged"),
+		dbus.WithMatchArg(0, "org.freedesktop.PolicyKit1"),
+	)
+	if err != nil {
+		warnf("Failed to watch for polkit restarts: %v", err)
+		return nil
+	}
+
+	signals := make(chan *dbus.Signal, 4)
+	conn.Signal(signals)
+
+	return signals
+}
+
+// polkitOwnerChanged registers the agent again once polkit is back. When
+// polkit went away the pending requests can't be answered anymore, so
+// their prompts are closed.
+func polkitOwnerChanged(conn *dbus.Conn, agent *Agent, subject Subject, s *dbus.Signal) {
+	if s.Name != "org.freedesktop.DBus.NameOwnerChanged" || len(s.Body) != 3 {
+		return
+	}
+
+	if owner, _ := s.Body[2].(string); owner == "" {
+		warnf("polkit left the bus, waiting for it to come back")
+		agent.cancelPrompts()
+		return
+	}
+
+	infof("polkit restarted, registering again")
+
+	if err := registerAgent(conn, subject); err != nil {
+		warnf("Failed to register with the restarted polkit: %v", err)
+		return
+	}
+
+	infof("Successfully registered authentication agent")
+}
+
+// shutdown lets requests in flight finish for up to shutdown_drain_seconds,
+// so a restart doesn't cut off users typing their password, then
+// unregisters the agent and runs on_unregister_command. Requests still pending are abandoned, polkit fails
+// them once the agent is gone.
+func shutdown(conn *dbus.Conn, agent *Agent, subject Subject) {
+	drain := time.Duration(conf().ShutdownDrainSeconds) * time.Second
+
+	if !agent.drain(drain) {
+		infof("Requests still pending after %s, cancelling them", drain)
+		agent.cancelPrompts()
+	}
+
+	if err := unregisterAgent(conn, subject); err != nil {
+		warnf("Failed to unregister authentication agent: %v", err)
+	} else {
+		runHook("on_unregister_command", conf().OnUnregisterCommand, fmt.Sprintf("WPKA_SESSION_ID=%s", agent.session))
+	}
+
+	if os.Geteuid() == 0 {
+		if _, err := conn.ReleaseName(agentBusName); err != nil {
+			warnf("Failed to release name: %v", err)
+		}
+	}
+
+	infof("Authentication agent unregistered")
+}
+
+// toolkitBackends are the variables making each toolkit use wayland.
+var toolkitBackends = map[string]string{
+	"gtk":     "GDK_BACKEND=wayland",
+	"qt":      "QT_QPA_PLATFORM=wayland",
+	"clutter": "CLUTTER_BACKEND=wayland",
+	"sdl":     "SDL_VIDEODRIVER=wayland",
+	"efl":     "ELM_DISPLAY=wl",
+}
+
+// toolkitEnv returns the backend variables for the given toolkits, "all"
+// selects every known toolkit.
+func toolkitEnv(hints []string) []string {
+	res := []string{}
+
+	for _, hint := range hints {
+		if hint == "all" {
+			for _, v := range toolkitBackends {
+				res = append(res, v)
+			}
+			continue
+		}
+
+		res = append(res, toolkitBackends[hint])
+	}
+
+	return res
+}
+
+// getCurrentUser returns the user wpka acts for: the user that invoked sudo
+// when running as root, else the user wpka runs as.
+func getCurrentUser() (*user.User, error) {
+	if os.Geteuid() != 0 {
+		return user.LookupId(strconv.Itoa(os.Getuid()))
+	}
+
+	sudoUser := os.Getenv("SUDO_USER")
+	if sudoUser == "" {
+		return nil, fmt.Errorf("SUDO_USER environment variable not set")
+	}
+	return lookupUser(sudoUser)
+}
+
+// lookupUser wraps user.Lookup with retries. Directory services like LDAP or
+// SSSD can fail transiently, an unknown user is not retried.
+func lookupUser(username string) (*user.User, error) {
+	for attempt := 0; ; attempt++ {
+		u, err := user.Lookup(username)
+		if err == nil {
+			return u, nil
+		}
+
+		var unknown user.UnknownUserError
+		if errors.As(err, &unknown) {
+			infof("User %s does not exist", username)
+			return nil, err
+		}
+
+		if attempt >= conf().UserLookupRetries {
+			infof("User lookup for %s failed, user database unavailable: %v", username, err)
+			return nil, err
+		}
+
+		infof("User lookup for %s failed, retrying: %v", username, err)
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// sessionEnv is the environment of the user's session and the process it
+// was read from, 0 when it came from env_command.
+type sessionEnv struct {
+	pid  int
+	vars map[string]string
+}
+
+// getOriginalEnv gets the environment variables from the user's session
+//
+// Wayland sessions are found by WAYLAND_DISPLAY, X11 sessions by DISPLAY.
+// Nested compositors are detected by the user's processes disagreeing on
+// the display. Processes are looked at by pid, so the display seen first
+// belongs to the oldest processes and is taken as the session's (outer)
+// display, later ones belong to nested compositors started inside it.
+// nested_display picks which one the prompt uses.
+func getOriginalEnv(username string) (sessionEnv, error) {
+	if !conf().EnvCommand.Empty() {
+		vars, err := envFromCommand(conf().EnvCommand)
+		return sessionEnv{vars: vars}, err
+	}
+
+	u, err := lookupUser(username)
+	if err != nil {
+		return sessionEnv{}, err
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return sessionEnv{}, err
+	}
+
+	pids, err := userProcesses(uint32(uid))
+	if err != nil {
+		return sessionEnv{}, err
+	}
+
+	procs := []sessionEnv{}
+
+	for _, pid := range pids {
+		vars, err := readEnviron(pid)
+		if err != nil {
+			// processes exit while being looked at
+			continue
+		}
+
+		procs = append(procs, sessionEnv{pid: pid, vars: vars})
+	}
+
+	// Xwayland sets DISPLAY in wayland sessions too, so wayland comes first
+	for _, key := range []string{"WAYLAND_DISPLAY", "DISPLAY"} {
+		if env, ok := pickDisplay(procs, key); ok {
+			fillSessionBus(env, procs)
+			return env, nil
+		}
+	}
+
+	return sessionEnv{}, fmt.Errorf("no graphical session found")
+}
+
+// fillSessionBus copies DBUS_SESSION_BUS_ADDRESS into env from another of
+// procs when env's process doesn't have it, f.e. because it was started
+// before the address was imported into the session.
+func fillSessionBus(env sessionEnv, procs []sessionEnv) {
+	if env.vars["DBUS_SESSION_BUS_ADDRESS"] != "" {
+		return
+	}
+
+	for _, proc := range procs {
+		if addr := proc.vars["DBUS_SESSION_BUS_ADDRESS"]; addr != "" {
+			env.vars["DBUS_SESSION_BUS_ADDRESS"] = addr
+			return
+		}
+	}
+}
+
+// userRuntimeDir returns the runtime dir of the user with uid, as found in
+// the session environment vars. It falls back to /run/user/<uid>, where
+// logind creates it.
+func userRuntimeDir(vars map[string]string, uid string) string {
+	if dir := vars["XDG_RUNTIME_DIR"]; dir != "" {
+		return dir
+	}
+
+	return filepath.Join("/run/user", uid)
+}
+
+// defaultSessionBus returns the address of the session bus systemd and
+// dbus-broker put into the user's runtime dir, if its socket exists.
+func defaultSessionBus(runtimeDir string) (string, bool) {
+	path := filepath.Join(runtimeDir, "bus")
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+
+	return "unix:path=" + path, true
+}
+
+// pickDisplay picks the environment of the session's display among procs,
+// key is the variable naming the display. It reports false when no process
+// has key set.
+func pickDisplay(procs []sessionEnv, key string) (sessionEnv, bool) {
+	displays := []string{}
+	envs := make(map[string]sessionEnv)
+
+	for _, proc := range procs {
+		display := proc.vars[key]
+		if display == "" {
+			continue
+		}
+
+		env, seen := envs[display]
+		if !seen {
+			displays = append(displays, display)
+		}
+
+		// prefer a process that also knows the runtime dir, some
+		// processes only got the display imported
+		if !seen || (env.vars["XDG_RUNTIME_DIR"] == "" && proc.vars["XDG_RUNTIME_DIR"] != "") {
+			envs[display] = proc
+		}
+	}
+
+	if len(displays) == 0 {
+		return sessionEnv{}, false
+	}
+
+	if len(displays) == 1 {
+		return envs[displays[0]], true
+	}
+
+	infof("Nested session detected, displays: %s", strings.Join(displays, ", "))
+
+	display := displays[0]
+
+	switch conf().NestedDisplay {
+	case "", "outer":
+	case "inner":
+		display = displays[len(displays)-1]
+	default:
+		if _, ok := envs[conf().NestedDisplay]; ok {
+			display = conf().NestedDisplay
+		} else {
+			infof("Configured nested_display %s not found, using %s", conf().NestedDisplay, display)
+		}
+	}
+
+	debugf("Using display: %s", display)
+
+	return envs[display], true
+}
+
+// userProcesses returns the pids of the processes owned by uid, in
+// ascending order.
+func userProcesses(uid uint32) ([]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	pids := []int{}
+
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Uid == uid {
+			pids = append(pids, pid)
+		}
+	}
+
+	sort.Ints(pids)
+
+	return pids, nil
 }
 
-// BeginAuthentication handles the authentication request
-func (a *Agent) BeginAuthentication(actionId string, message string, iconName string, details map[string]string, cookie string, identities []interface{}) *dbus.Error {
-	log.Printf("Authentication requested for action: %s\n", actionId)
-	log.Printf("Message: %s\n", message)
-	log.Printf("Cookie: %s\n", cookie)
+// readEnviron reads the environment of pid from /proc/<pid>/environ,
+// entries are separated by NUL bytes so values may contain anything else.
+func readEnviron(pid int) (map[string]string, error) {
+	b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]string)
 
-	currentUser := os.Getenv("SUDO_USER")
-	if currentUser == "" {
-		currentUser = os.Getenv("USER")
+	for _, entry := range strings.Split(string(b), "\x00") {
+		if key, value, ok := strings.Cut(entry, "="); ok && key != "" {
+			vars[key] = value
+		}
 	}
-	if currentUser == "" {
-		log.Printf("Could not determine user")
-		return dbus.MakeFailedError(fmt.Errorf("could not determine user"))
+
+	return vars, nil
+}
+
+// envCache holds the last detected session environment.
+var envCache struct {
+	sync.Mutex
+	username string
+	env      sessionEnv
+	expires  time.Time
+}
+
+// cachedOriginalEnv returns the session environment, reusing the previous
+// result for env_cache_seconds. The cache is dropped once the process it was
+// read from is gone, f.e. after a compositor restart.
+func cachedOriginalEnv(username string) (map[string]string, error) {
+	if conf().EnvCacheSeconds == 0 {
+		env, err := waitForOriginalEnv(username)
+		return env.vars, err
 	}
 
-	log.Printf("Authenticating as user: %s", currentUser)
+	envCache.Lock()
+	defer envCache.Unlock()
 
-	userInfo, err := user.Lookup(currentUser)
-	if err != nil {
-		log.Printf("Failed to lookup user: %v", err)
-		return dbus.MakeFailedError(err)
+	if envCache.username == username && time.Now().Before(envCache.expires) {
+		pid := envCache.env.pid
+		if pid == 0 {
+			return envCache.env.vars, nil
+		}
+
+		if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(pid))); err == nil {
+			return envCache.env.vars, nil
+		}
+
+		infof("Session process %d is gone, refreshing environment", pid)
 	}
 
-	uid, err := strconv.ParseUint(userInfo.Uid, 10, 32)
+	env, err := waitForOriginalEnv(username)
 	if err != nil {
-		log.Printf("Failed to parse UID: %v", err)
-		return dbus.MakeFailedError(err)
+		return nil, err
 	}
 
-	password, err := getPassword()
-	if err != nil {
-		log.Printf("Failed to get password: %v", err)
-		return dbus.MakeFailedError(err)
+	envCache.username = username
+	envCache.env = env
+	envCache.expires = time.Now().Add(time.Duration(conf().EnvCacheSeconds) * time.Second)
+
+	return env.vars, nil
+}
+
+// envFromCommand runs env_command as the invoking user and parses its
+// output as KEY=VALUE entries, separated by newlines or NUL bytes.
+func envFromCommand(command Command) (map[string]string, error) {
+	cmd := command.Cmd()
+	cmd.Env = os.Environ()
+	if err := asInvokingUser(cmd); err != nil {
+		return nil, fmt.Errorf("not running env_command: %w", err)
 	}
 
-	err = PAMAuth("passwd", currentUser, password)
+	output, err := cmd.Output()
 	if err != nil {
-		log.Printf("Failed to authenticate with PAM: %v", err)
-		return dbus.MakeFailedError(fmt.Errorf("invalid password"))
+		return nil, fmt.Errorf("env_command failed: %v", err)
 	}
 
-	log.Printf("Password verified for user %s (uid: %d)", currentUser, uid)
-
-	// Create the identity structure in the format PolicyKit expects: (sa{sv})
-	identity := struct {
-		Kind    string
-		Details map[string]dbus.Variant
-	}{
-		Kind: "unix-user",
-		Details: map[string]dbus.Variant{
-			"uid": dbus.MakeVariant(uint32(uid)),
-		},
+	sep := "\n"
+	if strings.Contains(string(output), "\x00") {
+		sep = "\x00"
 	}
 
-	// Send authentication response
-	obj := a.conn.Object("org.freedesktop.PolicyKit1", "/org/freedesktop/PolicyKit1/Authority")
-	call := obj.Call("org.freedesktop.PolicyKit1.Authority.AuthenticationAgentResponse2", 0,
-		uint32(uid), // u
-		cookie,      // s
-		identity,    // (sa{sv})
-	)
+	env := make(map[string]string)
 
-	if call.Err != nil {
-		log.Printf("Failed to send authentication response: %v", call.Err)
-		return dbus.MakeFailedError(call.Err)
+	for _, entry := range strings.Split(string(output), sep) {
+		entry = strings.TrimSuffix(entry, "\r")
+		if entry == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok || !validEnvKey(key) {
+			return nil, fmt.Errorf("env_command printed an invalid entry: %q", entry)
+		}
+
+		env[key] = value
 	}
 
-	log.Println("Authentication response sent successfully")
-	return nil
+	if len(env) == 0 {
+		return nil, fmt.Errorf("env_command printed no environment")
+	}
+
+	return env, nil
 }
 
-func (a *Agent) CancelAuthentication(cookie string) *dbus.Error {
-	log.Printf("Authentication cancelled for cookie: %s\n", cookie)
-	return nil
+// validEnvKey reports whether key is a valid environment variable name.
+func validEnvKey(key string) bool {
+	if key == "" || (key[0] >= '0' && key[0] <= '9') {
+		return false
+	}
+
+	for _, r := range key {
+		if r != '_' && (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+
+	return true
 }
 
-func getCurrentSession() (string, error) {
-	if session := os.Getenv("XDG_SESSION_ID"); session != "" {
-		return session, nil
+// promptHome returns home if it is an existing directory. Service accounts
+// often have none, the runtime dir or the temp dir is used instead then.
+func promptHome(home, runtimeDir string) string {
+	if info, err := os.Stat(home); err == nil && info.IsDir() {
+		return home
 	}
 
-	cmd := exec.Command("loginctl", "show-session", "self", "--property=Id")
-	output, err := cmd.Output()
-	if err == nil {
-		session := strings.TrimPrefix(strings.TrimSpace(string(output)), "Id=")
-		return session, nil
+	fallback := runtimeDir
+	if info, err := os.Stat(fallback); err != nil || !info.IsDir() {
+		fallback = os.TempDir()
 	}
 
-	cmd = exec.Command("loginctl", "list-sessions", "--no-legend")
-	output, err = cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to get session: %v", err)
+	infof("Home directory %q does not exist, using %s", home, fallback)
+
+	return fallback
+}
+
+// checkWaylandSocket verifies that the socket of display exists. A stale
+// WAYLAND_DISPLAY is replaced by the first wayland socket found in
+// runtimeDir, if any. Relative displays are resolved against runtimeDir.
+func checkWaylandSocket(display, runtimeDir string) string {
+	path := display
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(runtimeDir, display)
 	}
 
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	if len(lines) > 0 {
-		fields := strings.Fields(lines[0])
-		if len(fields) > 0 {
-			return fields[0], nil
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		return display
+	}
+
+	warnf("Wayland socket %s does not exist, WAYLAND_DISPLAY is stale", path)
+
+	sockets, _ := filepath.Glob(filepath.Join(runtimeDir, "wayland-*"))
+	for _, socket := range sockets {
+		if info, err := os.Stat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			infof("Using wayland socket %s instead", socket)
+			return filepath.Base(socket)
 		}
 	}
 
-	return "", fmt.Errorf("no session found")
+	return display
 }
 
-func main() {
-	conn, err := dbus.SystemBus()
+// defaultLocale is used when the locale isn't configured and the session
+// environment doesn't name one.
+const defaultLocale = "en_US.UTF-8"
+
+// sessionLocale returns the locale messages should be translated into,
+// taken from the user's session environment like the locale category
+// variables are resolved: LC_ALL, then LC_MESSAGES, then LANG.
+func sessionLocale() string {
+	u, err := getCurrentUser()
 	if err != nil {
-		log.Fatalf("Failed to connect to system bus: %v", err)
+		debugf("Using locale %s, no user: %v", defaultLocale, err)
+		return defaultLocale
 	}
 
-	reply, err := conn.RequestName(agentBusName,
-		dbus.NameFlagDoNotQueue)
+	env, err := getOriginalEnv(u.Username)
 	if err != nil {
-		log.Fatalf("Failed to request name: %v", err)
+		debugf("Using locale %s, no session environment: %v", defaultLocale, err)
+		return defaultLocale
 	}
 
-	if reply != dbus.RequestNameReplyPrimaryOwner {
-		log.Fatal("Name already taken")
+	for _, key := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if v := env.vars[key]; v != "" {
+			return v
+		}
 	}
 
-	agent := &Agent{conn: conn}
-	err = conn.Export(agent, dbus.ObjectPath(agentPath), agentInterface)
-	if err != nil {
-		log.Fatalf("Failed to export agent: %v", err)
-	}
+	return defaultLocale
+}
 
-	sessionId, err := getCurrentSession()
-	if err != nil {
-		log.Fatalf("Failed to get current session: %v", err)
+// waitForOriginalEnv retries getOriginalEnv for up to display_wait_seconds.
+// Requests can arrive at session start before the compositor is up.
+func waitForOriginalEnv(username string) (sessionEnv, error) {
+	env, err := getOriginalEnv(username)
+	if err == nil || conf().DisplayWaitSeconds == 0 {
+		return env, err
 	}
-	log.Printf("Using session ID: %s", sessionId)
 
-	// Create the subject structure exactly as PolicyKit expects
-	subject := Subject{
-		Kind: "unix-session",
-		Details: map[string]dbus.Variant{
-			"session-id": dbus.MakeVariant(sessionId),
-		},
+	wait := time.Duration(conf().DisplayWaitSeconds) * time.Second
+	infof("No graphical session found yet, waiting up to %s", wait)
+
+	start := time.Now()
+	for time.Since(start) < wait {
+		time.Sleep(500 * time.Millisecond)
+
+		env, err = getOriginalEnv(username)
+		if err == nil {
+			infof("Graphical session appeared after %s", time.Since(start).Round(time.Millisecond))
+			return env, nil
+		}
 	}
 
-	obj := conn.Object("org.freedesktop.PolicyKit1", "/org/freedesktop/PolicyKit1/Authority")
-	call := obj.Call("org.freedesktop.PolicyKit1.Authority.RegisterAuthenticationAgent", 0,
-		subject,
-		"en_US.UTF-8",
-		agentPath,
+	return sessionEnv{}, err
+}
+
+// shellQuote quotes s as a single word for sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// expandPlaceholders substitutes {action_id}, {action}, {message} and
+// {icon} in the prompt command. Values are shell-quoted, so placeholders
+// must not be quoted in the command itself.
+func expandPlaceholders(command string, req promptRequest) string {
+	return placeholders(req, shellQuote).Replace(command)
+}
+
+// placeholders returns a replacer for the placeholders of req, passing each
+// value through quote.
+func placeholders(req promptRequest, quote func(string) string) *strings.Replacer {
+	return strings.NewReplacer(
+		"{action_id}", quote(req.ActionID),
+		"{action}", quote(req.ActionName),
+		"{message}", quote(req.Message),
+		"{icon}", quote(req.Icon),
 	)
+}
 
-	if call.Err != nil {
-		log.Fatalf("Failed to register authentication agent: %v", call.Err)
+// promptCmd returns the prompt command for req: the one of its actions
+// entry, prompt_command, or the arguments wpka was started with run through
+// sh -c. Arguments of an array prompt_command are passed as is, so their
+// placeholders aren't quoted.
+func promptCmd(req promptRequest) *exec.Cmd {
+	ctx := req.ctx
+	if ctx == nil {
+		ctx = context.Background()
 	}
 
-	// Also register with options
-	call = obj.Call("org.freedesktop.PolicyKit1.Authority.RegisterAuthenticationAgentWithOptions", 0,
-		subject,
-		"en_US.UTF-8",
-		agentPath,
-		map[string]dbus.Variant{},
-	)
+	c := req.command
+	if c.Empty() {
+		c = conf().PromptCommand
+	}
+	if c.Empty() {
+		return exec.CommandContext(ctx, "/bin/sh", "-c", expandPlaceholders(strings.Join(os.Args[1:], " "), req))
+	}
 
-	if call.Err != nil {
-		log.Printf("Warning: Failed to register with options: %v", call.Err)
+	if c.Shell {
+		return exec.CommandContext(ctx, "/bin/sh", "-c", expandPlaceholders(c.Args[0], req))
 	}
 
-	log.Println("Successfully registered authentication agent")
-	fmt.Println("PolicyKit agent started. Waiting for authentication requests...")
+	r := placeholders(req, func(s string) string { return s })
+
+	args := make([]string, len(c.Args))
+	for i, arg := range c.Args {
+		args[i] = r.Replace(arg)
+	}
 
-	select {}
+	return exec.CommandContext(ctx, args[0], args[1:]...)
 }
 
-func getCurrentUser() (*user.User, error) {
-	sudoUser := os.Getenv("SUDO_USER")
-	if sudoUser == "" {
-		return nil, fmt.Errorf("SUDO_USER environment variable not set")
+// checkPromptCommand makes sure the configured prompt command exists.
+func checkPromptCommand(c Command) error {
+	if c.Empty() || c.Shell {
+		return nil
 	}
-	return user.Lookup(sudoUser)
-}
 
-// getOriginalEnv gets the environment variables from the user's session
-func getOriginalEnv(username string) ([]string, error) {
-	cmd := exec.Command("ps", "e", "-u", username)
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, err
+	if _, err := exec.LookPath(c.Args[0]); err != nil {
+		return fmt.Errorf("prompt_command %q not found: %w", c.Args[0], err)
 	}
 
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		if strings.Contains(line, "WAYLAND_DISPLAY") {
-			return strings.Fields(line), nil
+	return nil
+}
+
+// selectPromptCommand sets prompt_command of c to the first of
+// prompt_commands whose executable is found. Without prompt_commands it
+// checks prompt_command instead.
+func selectPromptCommand(c *Config) error {
+	for pattern, o := range c.Actions {
+		if err := checkPromptCommand(o.PromptCommand); err != nil {
+			return fmt.Errorf("actions %q: %w", pattern, err)
 		}
 	}
-	return nil, fmt.Errorf("no wayland session found")
-}
 
-func execute() string {
-	if os.Geteuid() != 0 {
-		fmt.Println("This program must be run with sudo")
-		os.Exit(1)
+	if len(c.PromptCommands) == 0 {
+		return checkPromptCommand(c.PromptCommand)
 	}
 
-	currentUser, err := getCurrentUser()
-	if err != nil {
-		fmt.Printf("Error getting current user: %v\n", err)
-		os.Exit(1)
+	for _, cmd := range c.PromptCommands {
+		if cmd.Empty() {
+			continue
+		}
+
+		name := cmd.Args[0]
+		if cmd.Shell {
+			// the first word of a shell command is usually the tool
+			fields := strings.Fields(name)
+			if len(fields) == 0 {
+				continue
+			}
+			name = fields[0]
+		}
+
+		if _, err := exec.LookPath(name); err != nil {
+			debugf("Prompt command %s not found: %v", name, err)
+			continue
+		}
+
+		infof("Using prompt command %s", name)
+		c.PromptCommand = cmd
+
+		return nil
 	}
 
-	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	return fmt.Errorf("none of the prompt_commands was found")
+}
+
+// runPrompt runs the prompt command and returns the password it printed.
+// extraEnv is added to the prompt's environment.
+func runPrompt(req promptRequest, extraEnv ...string) ([]byte, error) {
+	currentUser, err := getCurrentUser()
 	if err != nil {
-		fmt.Printf("Error parsing UID: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("Error getting current user: %w", err)
 	}
 
-	_, err = strconv.ParseUint(currentUser.Gid, 10, 32)
-	if err != nil {
-		fmt.Printf("Error parsing GID: %v\n", err)
-		os.Exit(1)
+	// without root the prompt simply runs as wpka's own user
+	var cred *syscall.Credential
+	if os.Geteuid() == 0 {
+		cred, err = userCredential(currentUser)
+		if err != nil {
+			return nil, fmt.Errorf("Error getting credentials: %w", err)
+		}
 	}
 
 	// Get original environment variables
-	origEnv, err := getOriginalEnv(currentUser.Username)
+	origEnv, err := cachedOriginalEnv(currentUser.Username)
 	if err != nil {
-		fmt.Printf("Error getting original environment: %v\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("Error getting original environment: %w", err)
+	}
+
+	// the cached map is shared between requests
+	envMap := maps.Clone(origEnv)
+
+	runtimeDir := userRuntimeDir(envMap, currentUser.Uid)
+
+	sessionType := "x11"
+	if display, ok := envMap["WAYLAND_DISPLAY"]; ok {
+		sessionType = "wayland"
+		envMap["WAYLAND_DISPLAY"] = checkWaylandSocket(display, runtimeDir)
 	}
 
-	// Parse environment variables
-	envMap := make(map[string]string)
-	for _, env := range origEnv {
-		if strings.Contains(env, "=") {
-			parts := strings.SplitN(env, "=", 2)
-			envMap[parts[0]] = parts[1]
+	if _, ok := envMap["DBUS_SESSION_BUS_ADDRESS"]; !ok {
+		if addr, ok := defaultSessionBus(runtimeDir); ok {
+			envMap["DBUS_SESSION_BUS_ADDRESS"] = addr
 		}
 	}
 
-	args := os.Args[1:]
+	if _, ok := envMap["XAUTHORITY"]; !ok && sessionType == "x11" {
+		// without XAUTHORITY X11 clients look here, but wpka's HOME is root's
+		path := filepath.Join(currentUser.HomeDir, ".Xauthority")
+		if _, err := os.Stat(path); err == nil {
+			envMap["XAUTHORITY"] = path
+		}
+	}
 
-	cmd := exec.Command("sh", "-c", strings.Join(args, " "))
+	cmd := promptCmd(req)
 
 	// Build environment variables list
 	var envList []string
@@ -282,60 +2059,361 @@ func execute() string {
 
 	// Add essential variables
 	envList = append(envList,
-		fmt.Sprintf("HOME=%s", currentUser.HomeDir),
+		fmt.Sprintf("HOME=%s", promptHome(currentUser.HomeDir, runtimeDir)),
 		fmt.Sprintf("USER=%s", currentUser.Username),
 		fmt.Sprintf("LOGNAME=%s", currentUser.Username),
-		fmt.Sprintf("XDG_RUNTIME_DIR=/run/user/%d", uid),
-		"XDG_SESSION_TYPE=wayland",
-		"GDK_BACKEND=wayland",
+		// the user's login shell may be nologin
+		"SHELL=/bin/sh",
+		fmt.Sprintf("XDG_RUNTIME_DIR=%s", runtimeDir),
+		fmt.Sprintf("XDG_SESSION_TYPE=%s", sessionType),
+		fmt.Sprintf("LC_MESSAGES=%s", conf().Locale),
+		fmt.Sprintf("WPKA_MASK=%s", conf().Mask),
+		fmt.Sprintf("WPKA_AUTH_KIND=%s", req.AuthKind),
+		fmt.Sprintf("WPKA_ACTION_NAME=%s", req.ActionName),
+		fmt.Sprintf("WPKA_ACTION_ID=%s", req.ActionID),
+		fmt.Sprintf("WPKA_MESSAGE=%s", req.Message),
+		fmt.Sprintf("WPKA_ICON=%s", req.Icon),
 	)
+	if sessionType == "wayland" {
+		envList = append(envList, toolkitEnv(conf().ToolkitHints)...)
+	}
+	if conf().InputMode == "fd" {
+		envList = append(envList, fmt.Sprintf("WPKA_PASSWORD_FD=%d", passwordFd))
+	}
+	envList = append(envList, extraEnv...)
 
 	cmd.Env = envList
 
-	// // Set the user and group
-	// cmd.SysProcAttr = &syscall.SysProcAttr{
-	// 	Credential: &syscall.Credential{
-	// 		Uid: uint32(uid),
-	// 		Gid: uint32(gid),
-	// 	},
-	// }
+	// the prompt runs as the user, in its own process group so cancelling
+	// reaches the tool started by sh -c as well
+	cmd.Dir = promptHome(currentUser.HomeDir, runtimeDir)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: cred}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = 2 * time.Second
+
+	runPromptHook("before_prompt_command", conf().BeforePromptCommand, envList, cred)
+	defer runPromptHook("after_prompt_command", conf().AfterPromptCommand, envList, cred)
 
 	// Run the command
-	out, err := cmd.CombinedOutput()
+	// stderr is logged, it must never end up in the password
+	stderr := &limitedBuffer{max: maxPromptOutput}
+	cmd.Stderr = stderr
+
+	var out []byte
+	if conf().InputMode == "fd" {
+		out, err = outputFromFd(cmd)
+	} else {
+		out, err = cmd.Output()
+	}
+
+	logPromptStderr(stderr.Bytes())
+
 	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			os.Exit(exitError.ExitCode())
+		pattern := errorPattern(out)
+		if pattern == "" {
+			pattern = errorPattern(stderr.Bytes())
+		}
+
+		if conf().DetectPromptErrors && pattern != "" {
+			warnf("Prompt command exited with an error and printed %q, is it configured correctly?", pattern)
+			return nil, fmt.Errorf("%w: %w", errPromptBroken, err)
+		}
+
+		return nil, fmt.Errorf("Error running command: %w", err)
+	}
+
+	return readPassword(out, conf().InputMode)
+}
+
+// limitedBuffer keeps the first max bytes written to it and discards the
+// rest.
+type limitedBuffer struct {
+	buf []byte
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.max - len(b.buf); n > 0 {
+		b.buf = append(b.buf, p[:min(n, len(p))]...)
+	}
+
+	return len(p), nil
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buf
+}
+
+// logPromptStderr logs the diagnostics the prompt wrote to stderr.
+func logPromptStderr(stderr []byte) {
+	for _, line := range strings.Split(strings.TrimSpace(string(stderr)), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			infof("prompt: %s", line)
+		}
+	}
+}
+
+// promptErrorPatterns are phrases in the output of a failing prompt that
+// hint at a misconfigured command rather than a typed password.
+var promptErrorPatterns = []string{"command not found", "no such file or directory", "usage:", "error"}
+
+// errorPattern returns the first of promptErrorPatterns found in out, case
+// insensitive, or "" if there is none. Only the first line is looked at,
+// that's where shells and most tools put the error.
+func errorPattern(out []byte) string {
+	line, _, _ := strings.Cut(strings.ToLower(string(out)), "\n")
+
+	for _, p := range promptErrorPatterns {
+		if strings.Contains(line, p) {
+			return p
+		}
+	}
+
+	return ""
+}
+
+// readPassword extracts the password from the prompt's output. In stdout
+// mode it is all of the output with exactly one trailing "\n" or "\r\n"
+// removed, other whitespace is kept since passwords may end in spaces. In
+// raw and fd mode it is everything up to EOF, unmodified. A single trailing
+// NUL byte is stripped in all modes. Output larger than maxPromptOutput is
+// rejected rather than truncated.
+func readPassword(out []byte, mode string) ([]byte, error) {
+	if len(out) > maxPromptOutput {
+		wipe(out)
+		return nil, fmt.Errorf("prompt output exceeds %d bytes", maxPromptOutput)
+	}
+
+	// pw shares out's memory, so wiping pw wipes all of out
+	pw := out
+
+	if mode == "stdout" {
+		if trimmed, ok := bytes.CutSuffix(pw, []byte("\n")); ok {
+			pw = bytes.TrimSuffix(trimmed, []byte("\r"))
 		}
-		fmt.Printf("Error running command: %v\n", err)
-		os.Exit(1)
 	}
 
-	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	// Some tools terminate their output with a NUL byte. PAM takes C
+	// strings, so any other NUL byte can't be part of a valid password.
+	pw = bytes.TrimSuffix(pw, []byte("\x00"))
+	if bytes.IndexByte(pw, 0) >= 0 {
+		wipe(out)
+		return nil, errors.New("prompt output contains a NUL byte")
+	}
+
+	return pw, nil
+}
+
+// wipe overwrites b with zeros, up to its capacity so the rest of the
+// prompt's output b was cut from is cleared as well. Copies Go made
+// elsewhere, f.e. when converting to string for PAM, are out of reach.
+func wipe(b []byte) {
+	clear(b[:cap(b)])
+}
+
+// maxPromptOutput limits how much is read from the prompt.
+const maxPromptOutput = 64 * 1024
+
+// passwordFd is the file descriptor the prompt writes the password to in fd
+// mode, the first of cmd.ExtraFiles.
+const passwordFd = 3
+
+// outputFromFd runs cmd with a pipe as fd 3 and returns what the prompt
+// wrote to it, reading one byte past maxPromptOutput to detect overlong
+// output. Prompts that leave the fd to a child process that doesn't
+// close it get a second after exiting.
+func outputFromFd(cmd *exec.Cmd) ([]byte, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	cmd.ExtraFiles = []*os.File{w}
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		out []byte
+		err error
+	}
+
+	read := make(chan result, 1)
+
+	go func() {
+		out, err := io.ReadAll(io.LimitReader(r, maxPromptOutput+1))
+		read <- result{out, err}
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-read:
+		return res.out, res.err
+	case <-time.After(time.Second):
+		return nil, fmt.Errorf("prompt did not close fd %d", passwordFd)
+	}
+}
+
+// showPAMMessage shows an informational PAM message, like an account lock
+// notice, using the prompt. Messages containing the password are dropped.
+func showPAMMessage(req promptRequest, msg string, password []byte) {
+	msg = sanitizePAMMessage(msg)
+	if msg == "" || (len(password) > 0 && bytes.Contains([]byte(msg), password)) {
+		return
+	}
+
+	req.Message = msg
+
+	if _, err := runPrompt(req, "WPKA_PROMPT=message"); err != nil {
+		warnf("Failed to show PAM message: %v", err)
+	}
+}
+
+// sanitizePAMMessage turns msg into a single line of at most 256 characters.
+func sanitizePAMMessage(msg string) string {
+	msg = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, msg)
+
+	msg = strings.Join(strings.Fields(msg), " ")
 
-	pw := ""
+	if runes := []rune(msg); len(runes) > 256 {
+		msg = string(runes[:256])
+	}
+
+	return msg
+}
 
-	for scanner.Scan() {
-		pw = scanner.Text()
+// pamResponse returns the answer to a PAM prompt as configured in
+// pam_conversation: "password", "username" or "empty".
+func pamResponse(answer, userName string, passwd func() ([]byte, error)) (string, error) {
+	switch answer {
+	case "username":
+		return userName, nil
+	case "empty":
+		return "", nil
 	}
 
-	return pw
+	pw, err := passwd()
+	return string(pw), err
+}
+
+// pamHandlers handle PAM messages that need the user.
+type pamHandlers struct {
+	// password asks for the password, once per transaction.
+	password func() ([]byte, error)
+
+	// message shows ErrorMsg and TextInfo messages. password is the one
+	// entered so far, if any.
+	message func(msg string, password []byte)
+
+	// prompt asks for a visible answer, f.e. a one-time code.
+	prompt func(msg string) (string, error)
+
+	// secret asks for a hidden answer, f.e. a hardware token's PIN.
+	secret func(msg string) (string, error)
+}
+
+// pamConversation answers the messages of one PAM transaction.
+type pamConversation struct {
+	userName string
+	h        pamHandlers
+
+	passwd       []byte
+	passwordErr  error
+	asked        bool
+	passwordSent bool
+
+	// err is the first error of a handler
+	err error
 }
 
-func PAMAuth(serviceName, userName, passwd string) error {
-	t, err := pam.StartFunc(serviceName, userName, func(s pam.Style, msg string) (string, error) {
-		switch s {
-		case pam.PromptEchoOff:
-			return passwd, nil
-		case pam.PromptEchoOn, pam.ErrorMsg, pam.TextInfo:
-			return "", nil
+// password asks for the password on first use and returns it afterwards.
+func (c *pamConversation) password() ([]byte, error) {
+	if !c.asked {
+		c.asked = true
+		c.passwd, c.passwordErr = c.h.password()
+	}
+	return c.passwd, c.passwordErr
+}
+
+// respond answers a single PAM message.
+func (c *pamConversation) respond(s pam.Style, msg string) (reply string, err error) {
+	defer func() {
+		if err != nil && c.err == nil {
+			c.err = err
+		}
+	}()
+
+	switch s {
+	case pam.PromptEchoOff:
+		if c.passwordSent {
+			answer := conf().PAMConversation.EchoOffAfterPassword
+			if answer == "prompt" && c.h.secret != nil {
+				return c.h.secret(msg)
+			}
+			return pamResponse(answer, c.userName, c.password)
+		}
+		c.passwordSent = true
+		return pamResponse(conf().PAMConversation.EchoOff, c.userName, c.password)
+	case pam.PromptEchoOn:
+		if c.passwordSent {
+			answer := conf().PAMConversation.EchoOnAfterPassword
+			if answer == "prompt" && c.h.prompt != nil {
+				return c.h.prompt(msg)
+			}
+			return pamResponse(answer, c.userName, c.password)
 		}
-		return "", errors.New("unrecognized PAM message style")
-	})
+		return pamResponse(conf().PAMConversation.EchoOn, c.userName, c.password)
+	case pam.ErrorMsg, pam.TextInfo:
+		if c.h.message != nil {
+			c.h.message(msg, c.passwd)
+		}
+		return "", nil
+	}
+	return "", errors.New("unrecognized PAM message style")
+}
+
+// PAMAuth authenticates userName. The password is asked for with
+// h.password when PAM first wants it, so a stack authenticating without one,
+// f.e. by fingerprint, shows no prompt. Prompts after the password, as 2FA
+// stacks ask for a one-time code, go to h.prompt (echo-on) and h.secret
+// (echo-off) unless pam_conversation says otherwise. An error of a handler
+// is returned instead of PAM's conversation error.
+func PAMAuth(serviceName, userName string, h pamHandlers) error {
+	c := &pamConversation{userName: userName, h: h}
+	defer func() { wipe(c.passwd) }()
+
+	t, err := pam.StartFunc(serviceName, userName, c.respond)
 	if err != nil {
 		return err
 	}
 
 	if err = t.Authenticate(0); err != nil {
+		if c.err != nil {
+			return c.err
+		}
+		return err
+	}
+
+	if err = t.AcctMgmt(0); err != nil {
+		// The pam bindings only expose pam_strerror's text for
+		// PAM_NEW_AUTHTOK_REQD.
+		if strings.Contains(err.Error(), "new one required") {
+			return errPasswordExpired
+		}
 		return err
 	}
 
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/msteinert/pam"
+)
+
+func TestReadPassword(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		out     string
+		want    string
+		wantErr bool
+	}{
+		{name: "stdout newline", mode: "stdout", out: "hunter2\n", want: "hunter2"},
+		{name: "stdout crlf", mode: "stdout", out: "hunter2\r\n", want: "hunter2"},
+		{name: "stdout only one newline", mode: "stdout", out: "hunter2\n\n", want: "hunter2\n"},
+		{name: "stdout no newline", mode: "stdout", out: "hunter2", want: "hunter2"},
+		{name: "stdout keeps spaces", mode: "stdout", out: " hunter2 \n", want: " hunter2 "},
+		{name: "stdout keeps tab", mode: "stdout", out: "hunter2\t\n", want: "hunter2\t"},
+		{name: "stdout lone cr", mode: "stdout", out: "hunter2\r", want: "hunter2\r"},
+		{name: "stdout multi-line", mode: "stdout", out: "hunter2\nsecond\n", want: "hunter2\nsecond"},
+		{name: "raw keeps newline", mode: "raw", out: "hunter2\n", want: "hunter2\n"},
+		{name: "raw keeps crlf", mode: "raw", out: "hunter2\r\n", want: "hunter2\r\n"},
+		{name: "fd keeps newline", mode: "fd", out: "hunter2\n", want: "hunter2\n"},
+		{name: "fd trailing nul", mode: "fd", out: "hunter2\x00", want: "hunter2"},
+		{name: "trailing nul", mode: "raw", out: "pw\x00", want: "pw"},
+		{name: "stdout nul before newline", mode: "stdout", out: "pw\x00\n", want: "pw"},
+		{name: "two trailing nuls", mode: "raw", out: "pw\x00\x00", wantErr: true},
+		{name: "embedded nul", mode: "raw", out: "p\x00w", wantErr: true},
+		{name: "stdout embedded nul", mode: "stdout", out: "p\x00w\n", wantErr: true},
+		{name: "empty", mode: "stdout", out: "", want: ""},
+		{name: "max size", mode: "raw", out: strings.Repeat("a", maxPromptOutput), want: strings.Repeat("a", maxPromptOutput)},
+		{name: "overlong", mode: "raw", out: strings.Repeat("a", maxPromptOutput+1), wantErr: true},
+		{name: "overlong stdout", mode: "stdout", out: strings.Repeat("a", maxPromptOutput) + "\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := []byte(tt.out)
+
+			pw, err := readPassword(out, tt.mode)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readPassword(%q, %q) = %q, want an error", tt.out, tt.mode, pw)
+				}
+				if bytes.ContainsFunc(out, func(r rune) bool { return r != 0 }) {
+					t.Errorf("output not wiped after error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readPassword(%q, %q) failed: %v", tt.out, tt.mode, err)
+			}
+			if string(pw) != tt.want {
+				t.Errorf("readPassword(%q, %q) = %q, want %q", tt.out, tt.mode, pw, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandPlaceholders(t *testing.T) {
+	messages := []string{
+		"plain",
+		"",
+		"it's",
+		"''",
+		`'\''`,
+		"$(touch /tmp/wpka-pwned)",
+		"`id`",
+		"$HOME ${HOME}",
+		"a; echo injected",
+		"a && echo injected | cat",
+		"line one\nline two",
+		`back\slash "double"`,
+		"*?[a]",
+		"{icon}",
+	}
+
+	for _, msg := range messages {
+		t.Run(msg, func(t *testing.T) {
+			req := promptRequest{ActionID: "org.example.a", ActionName: "it's", Message: msg, Icon: "$(id)"}
+
+			command := expandPlaceholders("printf '%s|' {message} {action} {icon} {action_id}", req)
+
+			out, err := exec.Command("/bin/sh", "-c", command).Output()
+			if err != nil {
+				t.Fatalf("sh -c %q failed: %v", command, err)
+			}
+
+			want := msg + "|it's|$(id)|org.example.a|"
+			if string(out) != want {
+				t.Errorf("sh -c %q printed %q, want %q", command, out, want)
+			}
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, s := range []string{"", "a b", "it's", "'", "$(id)", "`id`", "a\nb", `\'`} {
+		out, err := exec.Command("/bin/sh", "-c", "printf %s "+shellQuote(s)).Output()
+		if err != nil {
+			t.Fatalf("shellQuote(%q) failed in sh: %v", s, err)
+		}
+		if string(out) != s {
+			t.Errorf("shellQuote(%q) printed %q", s, out)
+		}
+	}
+}
+
+// fakeConversation returns a pamConversation whose handlers record their
+// calls in calls.
+func fakeConversation(calls *[]string) *pamConversation {
+	return &pamConversation{
+		userName: "alice",
+		h: pamHandlers{
+			password: func() ([]byte, error) {
+				*calls = append(*calls, "password")
+				return []byte("hunter2"), nil
+			},
+			prompt: func(msg string) (string, error) {
+				*calls = append(*calls, "prompt "+msg)
+				return "123456", nil
+			},
+			secret: func(msg string) (string, error) {
+				*calls = append(*calls, "secret "+msg)
+				return "0000", nil
+			},
+			message: func(msg string, password []byte) {
+				*calls = append(*calls, "message "+msg+" "+string(password))
+			},
+		},
+	}
+}
+
+func TestPAMConversation(t *testing.T) {
+	type step struct {
+		style pam.Style
+		msg   string
+		reply string
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+		calls []string
+	}{
+		{
+			name: "password only",
+			steps: []step{
+				{pam.PromptEchoOff, "Password: ", "hunter2"},
+			},
+			calls: []string{"password"},
+		},
+		{
+			name: "login then password",
+			steps: []step{
+				{pam.PromptEchoOn, "login: ", "alice"},
+				{pam.PromptEchoOff, "Password: ", "hunter2"},
+			},
+			calls: []string{"password"},
+		},
+		{
+			name: "one-time code after password",
+			steps: []step{
+				{pam.PromptEchoOff, "Password: ", "hunter2"},
+				{pam.PromptEchoOn, "Verification code: ", "123456"},
+			},
+			calls: []string{"password", "prompt Verification code: "},
+		},
+		{
+			name: "pin after password",
+			steps: []step{
+				{pam.PromptEchoOff, "Password: ", "hunter2"},
+				{pam.TextInfo, "Touch your token", ""},
+				{pam.PromptEchoOff, "PIN: ", "0000"},
+			},
+			calls: []string{"password", "message Touch your token hunter2", "secret PIN: "},
+		},
+		{
+			name: "message before password",
+			steps: []step{
+				{pam.ErrorMsg, "Place your finger", ""},
+			},
+			calls: []string{"message Place your finger "},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []string
+			c := fakeConversation(&calls)
+
+			for _, s := range tt.steps {
+				reply, err := c.respond(s.style, s.msg)
+				if err != nil {
+					t.Fatalf("respond(%v, %q) failed: %v", s.style, s.msg, err)
+				}
+				if reply != s.reply {
+					t.Errorf("respond(%v, %q) = %q, want %q", s.style, s.msg, reply, s.reply)
+				}
+			}
+
+			if !reflect.DeepEqual(calls, tt.calls) {
+				t.Errorf("handlers called %q, want %q", calls, tt.calls)
+			}
+		})
+	}
+}
+
+func TestPAMConversationAsksPasswordOnce(t *testing.T) {
+	old := conf()
+	t.Cleanup(func() { config.Store(old) })
+	updateConfig(func(c *Config) {
+		c.PAMConversation.EchoOffAfterPassword = "password"
+		c.PAMConversation.EchoOnAfterPassword = "empty"
+	})
+
+	var calls []string
+	c := fakeConversation(&calls)
+
+	for _, s := range []pam.Style{pam.PromptEchoOff, pam.PromptEchoOff, pam.PromptEchoOn} {
+		if _, err := c.respond(s, ""); err != nil {
+			t.Fatalf("respond(%v) failed: %v", s, err)
+		}
+	}
+
+	if !reflect.DeepEqual(calls, []string{"password"}) {
+		t.Errorf("handlers called %q, want the password once", calls)
+	}
+}
+
+func TestPAMConversationKeepsFirstError(t *testing.T) {
+	var calls []string
+	c := fakeConversation(&calls)
+	c.h.prompt = func(string) (string, error) { return "", errPromptCancelled }
+
+	if _, err := c.respond(pam.PromptEchoOff, "Password: "); err != nil {
+		t.Fatalf("password failed: %v", err)
+	}
+	if _, err := c.respond(pam.PromptEchoOn, "Code: "); !errors.Is(err, errPromptCancelled) {
+		t.Fatalf("code returned %v, want errPromptCancelled", err)
+	}
+	if _, err := c.respond(pam.Style(-1), ""); err == nil {
+		t.Fatalf("unknown style didn't fail")
+	}
+
+	if !errors.Is(c.err, errPromptCancelled) {
+		t.Errorf("conversation error is %v, want errPromptCancelled", c.err)
+	}
+}
+
+func TestDrainIdle(t *testing.T) {
+	var a Agent
+	if !a.drain(0) {
+		t.Errorf("drain(0) of an idle agent reported pending requests")
+	}
+	if a.track() {
+		t.Errorf("request tracked after drain")
+	}
+}